@@ -3,20 +3,32 @@ package aggregator
 import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/google/logger"
+	"github.com/kiwivogel/ecr-scan-util/helpers"
 )
 
-// EcrGetScanResults pulls results from the latest image scan for a given ecr.Image it uses a globally defined session.Session and outputs stdout messages to a logger.Logger.
+// EcrGetScanResults pulls results from the latest image scan for a given ecr.Image it uses a shared ecr.ECR client and outputs stdout messages to a logger.Logger.
+// When StartScan is set in the helpers.ScanConfig it starts a scan for images that have not been scanned yet and waits for
+// scans that are in progress to complete.
 // It returns a pointer to a ecr.DescribeImageScanFindingsOutput and an error.
-func EcrGetScanResults(image *ecr.Image, session *session.Session, l *logger.Logger) (result *ecr.DescribeImageScanFindingsOutput, err error) {
-	svc := ecr.New(session)
+func EcrGetScanResults(image *ecr.Image, config helpers.ScanConfig, svc *ecr.ECR, l *logger.Logger) (result *ecr.DescribeImageScanFindingsOutput, err error) {
 	// Create input parameter for api call
 	input := createImageScanFindingsInput(image)
 
 	// Retrieve results of scan
-	result, err = svc.DescribeImageScanFindings(input)
+	result, err = describeImageScanFindings(svc, input)
+
+	// Optionally start a scan when none is present and wait for it (or an already running scan) to complete.
+	if config.StartScan && isScanNotFound(err) {
+		err = startImageScan(image, svc, l)
+		if err == nil {
+			result, err = waitForScanCompletion(svc, input, config, l)
+		}
+	} else if config.StartScan && err == nil && isScanInProgress(result) {
+		result, err = waitForScanCompletion(svc, input, config, l)
+	}
+
 	if err != nil {
 		if err, ok := err.(awserr.Error); ok {
 			// Handle specific error types as defined by the aws SDK
@@ -35,9 +47,9 @@ func EcrGetScanResults(image *ecr.Image, session *session.Session, l *logger.Log
 				l.Error(err.Error())
 			}
 		} else {
-			// Print the error, cast err to awserr. Error to get the Code and
-			// Message from an error.
-			l.Fatalf("%e is not a recognized Error", err.Error())
+			// Print the error, these are not returned by the ECR api but by our own logic (such as a timeout while
+			// waiting for a scan to complete).
+			l.Error(err.Error())
 		}
 		// Return an output struct with failed status and an error message when results cannot be retrieved.
 		return &ecr.DescribeImageScanFindingsOutput{
@@ -51,14 +63,50 @@ func EcrGetScanResults(image *ecr.Image, session *session.Session, l *logger.Log
 	return result, err
 }
 
+// describeImageScanFindings retrieves every page of findings for a given ecr.DescribeImageScanFindingsInput and merges
+// them into a single ecr.DescribeImageScanFindingsOutput. FindingSeverityCounts are recalculated from the merged findings
+// so they always match the findings we report on.
+func describeImageScanFindings(svc *ecr.ECR, input *ecr.DescribeImageScanFindingsInput) (result *ecr.DescribeImageScanFindingsOutput, err error) {
+	err = svc.DescribeImageScanFindingsPages(input, func(page *ecr.DescribeImageScanFindingsOutput, lastPage bool) bool {
+		if result == nil {
+			result = page
+		} else if result.ImageScanFindings == nil {
+			result.ImageScanFindings = page.ImageScanFindings
+		} else if page.ImageScanFindings != nil {
+			result.ImageScanFindings.Findings = append(result.ImageScanFindings.Findings, page.ImageScanFindings.Findings...)
+		}
+		return true
+	})
+	if err != nil || result == nil {
+		return result, err
+	}
+	result.NextToken = nil
+	if result.ImageScanFindings != nil {
+		result.ImageScanFindings.FindingSeverityCounts = countFindingSeverities(result.ImageScanFindings.Findings)
+	}
+	return result, err
+}
+
+// countFindingSeverities tallies a list of findings per severity in the same format ECR uses for FindingSeverityCounts.
+func countFindingSeverities(findings []*ecr.ImageScanFinding) (severityCounts map[string]*int64) {
+	severityCounts = make(map[string]*int64)
+	for f := range findings {
+		severity := aws.StringValue(findings[f].Severity)
+		if _, present := severityCounts[severity]; !present {
+			severityCounts[severity] = aws.Int64(0)
+		}
+		*severityCounts[severity]++
+	}
+	return severityCounts
+}
+
 // createImageScanFindingsInput takes an input ecr.Image and returns a ecr.DescribeImageScanFindingsInput that's used by
 // the ECR client to retrieve scan results. We do not return an error since ecr.Image object has been validated upstream.
-// Using a lazy hack to avoid implementing pagination.
 func createImageScanFindingsInput(image *ecr.Image) (input *ecr.DescribeImageScanFindingsInput) {
 	input = &ecr.DescribeImageScanFindingsInput{
 		RepositoryName: image.RepositoryName,
 		ImageId:        image.ImageId,
-		MaxResults:     aws.Int64(1000), //to avoid paginated results with more than 100 but less than 1000 results.
+		MaxResults:     aws.Int64(1000), //Largest page size allowed, remaining pages are retrieved by describeImageScanFindings.
 	}
 	if image.RegistryId != nil {
 		input.RegistryId = image.RegistryId
@@ -0,0 +1,95 @@
+package aggregator
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/google/logger"
+	"github.com/kiwivogel/ecr-scan-util/helpers"
+)
+
+// Contains logic to start scans for images that have not been scanned yet and to wait for (running) scans to complete.
+
+// ErrScanTimeout is returned (wrapped) by waitForScanCompletion when a scan does not complete in time.
+var ErrScanTimeout = errors.New("scan did not complete in time")
+
+// IsScanUnavailable checks if an error returned by EcrGetScanResults means the image has no (completed) scan rather than
+// that retrieving results failed.
+func IsScanUnavailable(err error) bool {
+	return isScanNotFound(err) || errors.Is(err, ErrScanTimeout)
+}
+
+// startImageScan starts a scan for a given ecr.Image using the supplied ecr.ECR client. Returns an error if the scan
+// could not be started.
+func startImageScan(image *ecr.Image, svc *ecr.ECR, l *logger.Logger) (err error) {
+	l.Infof("Starting scan for %s:%s", *image.RepositoryName, helpers.StringPointerChecker(image.ImageId.ImageTag, "<untagged>"))
+	_, err = svc.StartImageScan(createStartImageScanInput(image))
+	return err
+}
+
+// waitForScanCompletion polls ECR for the status of a scan until it leaves IN_PROGRESS or until the timeout in the
+// helpers.ScanConfig has passed. The interval between polls starts at ScanConfig.PollInterval and is doubled after every
+// poll, capped at ScanConfig.MaxPollInterval and at the time remaining, so the last poll happens at the deadline. Polls at
+// least once, even when the timeout is shorter than the interval.
+// Returns the last retrieved ecr.DescribeImageScanFindingsOutput and an error.
+func waitForScanCompletion(svc *ecr.ECR, input *ecr.DescribeImageScanFindingsInput, config helpers.ScanConfig, l *logger.Logger) (result *ecr.DescribeImageScanFindingsOutput, err error) {
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(config.Timeout)
+	interval := config.PollInterval
+
+	for {
+		sleep := interval
+		if remaining := time.Until(deadline); remaining < sleep {
+			sleep = remaining
+		}
+		if sleep > 0 {
+			l.Infof("Scan for %s in progress, checking again in %v", *input.RepositoryName, sleep)
+			time.Sleep(sleep)
+		}
+
+		result, err = describeImageScanFindings(svc, input)
+		// A freshly started scan may not be visible yet, we treat this the same as a scan that is still in progress.
+		if err != nil && !isScanNotFound(err) {
+			return nil, err
+		}
+		if err == nil && !isScanInProgress(result) {
+			return result, nil
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%w: %s did not complete within %v", ErrScanTimeout, *input.RepositoryName, config.Timeout)
+		}
+
+		interval = interval * 2
+		if interval > config.MaxPollInterval {
+			interval = config.MaxPollInterval
+		}
+	}
+}
+
+// isScanNotFound checks if an error returned by the ECR api is a ScanNotFoundException.
+func isScanNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == ecr.ErrCodeScanNotFoundException
+	}
+	return false
+}
+
+// isScanInProgress checks if the ImageScanStatus of a ecr.DescribeImageScanFindingsOutput is IN_PROGRESS.
+func isScanInProgress(result *ecr.DescribeImageScanFindingsOutput) bool {
+	return result.ImageScanStatus != nil && result.ImageScanStatus.Status != nil && *result.ImageScanStatus.Status == ecr.ScanStatusInProgress
+}
+
+// createStartImageScanInput takes an input ecr.Image and returns a ecr.StartImageScanInput that's used by the ECR
+// client to start a scan.
+func createStartImageScanInput(image *ecr.Image) *ecr.StartImageScanInput {
+	return &ecr.StartImageScanInput{
+		ImageId:        image.ImageId,
+		RegistryId:     image.RegistryId,
+		RepositoryName: image.RepositoryName,
+	}
+}
@@ -9,4 +9,5 @@ require (
 	github.com/google/logger v1.0.1
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 	gopkg.in/yaml.v2 v2.2.7
+	gopkg.in/yaml.v3 v3.0.1
 )
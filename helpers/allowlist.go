@@ -1,19 +1,221 @@
 package helpers
 
 import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/google/logger"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 // Handles allowlist logic
 
+// allowlistDateLayout is the layout of the expires field of an AllowlistEntry.
+const allowlistDateLayout = "2006-01-02"
+
+// SeverityRanks orders the severities reported by ECR, used for both the cutoff and severity capped allowlist entries.
+var SeverityRanks = map[string]int{
+	"INFORMATIONAL": -1,
+	"LOW":           0,
+	"MEDIUM":        1,
+	"HIGH":          2,
+	"CRITICAL":      3,
+}
+
 // Allowlist is a target struct we populate with values based on an allowlist yaml. To avoid a large list of duplicate entries
 // we use both Globally allowed packages and Image specific packages we allow.
+// Container keys can be globs or regular expressions (prefixed with "re:") to share entries between similarly named containers.
 type Allowlist struct {
-	GlobalPackages    []string            `yaml:"global_allowlist"`
-	ComponentPackages map[string][]string `yaml:"container_allowlist"`
+	GlobalPackages    []AllowlistEntry            `yaml:"global_allowlist"`
+	ComponentPackages map[string][]AllowlistEntry `yaml:"container_allowlist"`
+	containerPatterns map[string]*regexp.Regexp   // containerPatterns: Compiled container keys, set by allowlistParser
+}
+
+// allowlistEntryError is returned for entries (or container keys) that are valid yaml but not a valid allowlist entry.
+// node is the yaml node of the offending value (or entry), used by allowlistParser to state the line the error is on.
+type allowlistEntryError struct {
+	node *yaml.Node
+	err  error
+}
+
+// Error returns the message of the wrapped error.
+func (e allowlistEntryError) Error() string {
+	return e.err.Error()
+}
+
+// Kinds of allowlist rules, depending on whether an AllowlistEntry has a package, a CVE or both.
+const (
+	AllowlistRulePackage    = "package"
+	AllowlistRuleCVE        = "cve"
+	AllowlistRuleCVEPackage = "cve+package"
+)
+
+// AllowlistEntry is a single exception in an Allowlist. Entries are either plain strings ("package@version", the latter
+// part being optional, or a CVE-YYYY-NNNN identifier) or structured entries which can combine a package and CVE, be
+// time-boxed and record why and by whom they were approved.
+type AllowlistEntry struct {
+	Package     string `yaml:"package"`      // Package: Package (prefix, glob or "re:" regex) to allow, may include "@version". Optional if CVE is set
+	Version     string `yaml:"version"`      // Version: Version (prefix) of the package to allow, optional
+	CVE         string `yaml:"cve"`          // CVE: Vulnerability to allow (only in Package if set). Optional if Package is set
+	Expires     string `yaml:"expires"`      // Expires: Last day (YYYY-MM-DD) the entry suppresses findings, optional
+	MaxSeverity string `yaml:"max_severity"` // MaxSeverity: Highest severity the entry suppresses findings up to, optional
+	Reason      string `yaml:"reason"`       // Reason: Justification of the exception, optional
+	Owner       string `yaml:"owner"`        // Owner: Person or team that approved the exception, optional
+	Scope       string `yaml:"-"`            // Scope: Part of the Allowlist the entry came from, set by FlattenAllowlist
+
+	expiry     time.Time      // expiry: Parsed Expires, zero if the entry does not expire
+	packageExp *regexp.Regexp // packageExp: Compiled Pattern, nil for entries without package
+}
+
+// UnmarshalYAML lets an AllowlistEntry be unmarshalled from either a plain string or a structured entry. Plain strings
+// that are a CVE identifier (CVE-YYYY-NNNN) are treated as such, anything else as a package. Other vulnerability
+// identifiers (such as ALAS2-2019-1234) need the cve field of a structured entry.
+func (e *AllowlistEntry) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		var pattern string
+		if err := value.Decode(&pattern); err != nil {
+			return err
+		}
+		if isCVE(pattern) {
+			*e = AllowlistEntry{CVE: pattern}
+			return nil
+		}
+		*e = AllowlistEntry{Package: pattern}
+		if err := e.compile(); err != nil {
+			return allowlistEntryError{value, err}
+		}
+		return nil
+	}
+
+	// Decode into a type without the UnmarshalYAML method to avoid recursing.
+	type plainEntry AllowlistEntry
+	entry := plainEntry{}
+	if err := value.Decode(&entry); err != nil {
+		return err
+	}
+	*e = AllowlistEntry(entry)
+	if e.Package == "" && e.CVE == "" {
+		return allowlistEntryError{value, fmt.Errorf("allowlist entry without package or cve: %+v", entry)}
+	}
+	if e.Package == "" && e.Version != "" {
+		return allowlistEntryError{fieldNode(value, "version"),
+			fmt.Errorf("allowlist entry for %s has a version but no package", e.CVE)}
+	}
+	if isRegexPattern(e.Package) && e.Version != "" {
+		return allowlistEntryError{fieldNode(value, "version"),
+			fmt.Errorf("allowlist entry %s is a regular expression and can not have a version, include it in the expression", e.Package)}
+	}
+	if err := e.compile(); err != nil {
+		return allowlistEntryError{fieldNode(value, "package"), err}
+	}
+	if e.MaxSeverity != "" {
+		if _, known := SeverityRanks[strings.ToUpper(e.MaxSeverity)]; !known {
+			return allowlistEntryError{fieldNode(value, "max_severity"),
+				fmt.Errorf("allowlist entry %s has an invalid max_severity %s, expected INFORMATIONAL, LOW, MEDIUM, HIGH or CRITICAL", e, e.MaxSeverity)}
+		}
+		e.MaxSeverity = strings.ToUpper(e.MaxSeverity)
+	}
+	if e.Expires != "" {
+		expiry, err := time.Parse(allowlistDateLayout, e.Expires)
+		if err != nil {
+			return allowlistEntryError{fieldNode(value, "expires"),
+				fmt.Errorf("allowlist entry %s has an invalid expires date %q, expected YYYY-MM-DD", e, e.Expires)}
+		}
+		// Entries are valid up to and including the expiry date.
+		e.expiry = expiry.AddDate(0, 0, 1)
+	}
+	return nil
+}
+
+// compile compiles the Pattern of an AllowlistEntry (if it has a package). Plain patterns are matched as a prefix, as
+// is the version of a glob pattern (globs otherwise have to match completely). The version is whatever follows the last
+// "@", so "linux-*@4.9" and {package: linux-*, version: 4.9} match the same packages.
+func (e *AllowlistEntry) compile() (err error) {
+	if e.Package == "" {
+		return nil
+	}
+	pattern := e.Pattern()
+	if !isRegexPattern(pattern) && isGlob(pattern) {
+		if at := strings.LastIndex(pattern, "@"); at != -1 && at < len(pattern)-1 {
+			pattern += "*"
+		}
+	}
+	e.packageExp, err = compilePattern(pattern, true)
+	if err != nil {
+		return fmt.Errorf("allowlist entry %s is not a valid pattern: %v", e.Package, err)
+	}
+	return nil
+}
+
+// Pattern returns the "package@version" (prefix, glob or regex) a finding's package is matched against.
+func (e AllowlistEntry) Pattern() string {
+	if e.Version != "" {
+		return fmt.Sprintf("%s@%s", e.Package, e.Version)
+	}
+	return e.Package
+}
+
+// String returns the CVE and/or Pattern of an AllowlistEntry.
+func (e AllowlistEntry) String() string {
+	switch e.Kind() {
+	case AllowlistRuleCVE:
+		return e.CVE
+	case AllowlistRuleCVEPackage:
+		return fmt.Sprintf("%s in %s", e.CVE, e.Pattern())
+	default:
+		return e.Pattern()
+	}
+}
+
+// Kind returns the kind of rule an AllowlistEntry is: AllowlistRulePackage, AllowlistRuleCVE or AllowlistRuleCVEPackage.
+func (e AllowlistEntry) Kind() string {
+	if e.CVE == "" {
+		return AllowlistRulePackage
+	}
+	if e.Package == "" {
+		return AllowlistRuleCVE
+	}
+	return AllowlistRuleCVEPackage
+}
+
+// Expired returns true when an AllowlistEntry has an expiry date that has passed at the supplied time.
+func (e AllowlistEntry) Expired(now time.Time) bool {
+	return !e.expiry.IsZero() && !now.Before(e.expiry)
+}
+
+// AllowsSeverity returns true when an AllowlistEntry suppresses findings of a severity. Entries without MaxSeverity
+// suppress any severity, capped entries never suppress severities they can not be compared to (such as UNDEFINED).
+func (e AllowlistEntry) AllowsSeverity(severity string) bool {
+	if e.MaxSeverity == "" {
+		return true
+	}
+	rank, known := SeverityRanks[severity]
+	return known && rank <= SeverityRanks[e.MaxSeverity]
+}
+
+// Matches returns true when an AllowlistEntry applies to a vulnerability in a package ("package@version"), regardless
+// of whether it expired or the severity it is capped at.
+func (e AllowlistEntry) Matches(vulnerability string, pkg string) bool {
+	// Plain patterns are matched as a prefix because this allows us to specify package with and without
+	// a specific version (format in allow list is "package@version", the latter part being optional)
+	if e.packageExp != nil && !e.packageExp.MatchString(pkg) {
+		return false
+	} else if e.packageExp == nil && e.Package != "" && !strings.HasPrefix(pkg, e.Pattern()) {
+		return false
+	}
+	return e.CVE == "" || strings.EqualFold(e.CVE, vulnerability)
+}
+
+// cvePattern matches CVE identifiers (CVE-YYYY-NNNN), in any case.
+var cvePattern = regexp.MustCompile(`(?i)^CVE-\d{4}-\d+$`)
+
+// isCVE returns true when a string is a CVE identifier.
+func isCVE(s string) bool {
+	return cvePattern.MatchString(s)
 }
 
 // CreateAllowList opens and parses an allowlistFile (yaml, see README.MD for format) and outputs and Allowlist object and
@@ -22,11 +224,17 @@ func CreateAllowlist(allowListFile string, l logger.Logger) (allowlist Allowlist
 	if allowListFile != "" {
 		var wlBytes []byte
 		wlBytes, err = fileReader(allowListFile, &l)
+		if err != nil {
+			return allowlist, err
+		}
 		allowlist, err = allowlistParser(wlBytes)
+		if err == nil {
+			logExpiredEntries(allowlist, time.Now(), &l)
+		}
 	} else {
 		allowlist = Allowlist{
-			GlobalPackages:    []string{},
-			ComponentPackages: map[string][]string{},
+			GlobalPackages:    []AllowlistEntry{},
+			ComponentPackages: map[string][]AllowlistEntry{},
 		}
 	}
 	return allowlist, err
@@ -34,36 +242,145 @@ func CreateAllowlist(allowListFile string, l logger.Logger) (allowlist Allowlist
 
 // FlattenAllowlist is used to combine entries from global part and container specific entries in the allowlist for easier
 // checking for hits by InAllowList. Takes an Allowlist and containername. (container name is used here without baseRepo which is trimmed off)
-// Returns a []string with allowed packages.
-// TODO: Do we handle empty Allowlist.GlobalPackages?
-func FlattenAllowlist(a *Allowlist, c string) (allowlist []string) {
-	allowlist = a.GlobalPackages
-	if a.ComponentPackages[c] != nil {
-		allowlist = append(allowlist, a.ComponentPackages[c]...)
+// Entries of every container key matching the container name (either literally or as a glob/regex) are included.
+// Returns a []AllowlistEntry with allowed packages and CVEs, each with its Scope set.
+func FlattenAllowlist(a *Allowlist, c string) (allowlist []AllowlistEntry) {
+	// Copy the entries, modifying them directly would modify the Allowlist shared by concurrent workers.
+	for _, entry := range a.GlobalPackages {
+		entry.Scope = "global"
+		allowlist = append(allowlist, entry)
+	}
+	for _, key := range a.MatchingContainerKeys(c) {
+		for _, entry := range a.ComponentPackages[key] {
+			entry.Scope = fmt.Sprintf("container %s", key)
+			allowlist = append(allowlist, entry)
+		}
 	}
 	return allowlist
 }
 
-// InAllowList tests if a queried string is present in a list of strings.
-// Returns a boolean and the matching item on the list (this is useful because we can query substrings)
-func InAllowList(list []string, query string) (found bool, hit string) {
+// MatchingContainerKeys returns the (sorted) container keys of an Allowlist that match a container name.
+func (a *Allowlist) MatchingContainerKeys(c string) (keys []string) {
+	for key := range a.ComponentPackages {
+		if a.containerKeyMatches(key, c) {
+			keys = append(keys, key)
+		}
+	}
+	// Sort keys since we iterate over a map, keeps the order entries are matched in deterministic.
+	sort.Strings(keys)
+	return keys
+}
+
+// containerKeyMatches returns true when a container key of an Allowlist matches a container name.
+func (a *Allowlist) containerKeyMatches(key string, c string) bool {
+	pattern := a.containerPatterns[key]
+	return key == c || (pattern != nil && pattern.MatchString(c))
+}
+
+// InAllowList tests if a vulnerability of a severity in a package ("package@version") matches an entry (by package, CVE
+// or both) in a list of AllowlistEntry that has not expired at the supplied time and allows the severity.
+// Returns a boolean and the matching entry. When only expired or severity capped entries match it returns false and the
+// first of those entries, so callers can report why the finding is not suppressed.
+func InAllowList(list []AllowlistEntry, vulnerability string, pkg string, severity string, now time.Time) (found bool, hit AllowlistEntry) {
+	var rejected *AllowlistEntry
 	for v := range list {
-		// We check for the query using HasPrefix because this allows us to specify package with and without
-		// a specific version (format in allow list is "package@version", the latter part being optional)
-		if strings.HasPrefix(query, list[v]) {
+		if !list[v].Matches(vulnerability, pkg) {
+			continue
+		}
+		if !list[v].Expired(now) && list[v].AllowsSeverity(severity) {
 			return true, list[v]
 		}
+		if rejected == nil {
+			rejected = &list[v]
+		}
+	}
+	if rejected != nil {
+		return false, *rejected
+	}
+	return false, AllowlistEntry{}
+}
+
+// logExpiredEntries warns about every entry in an Allowlist that expired at the supplied time.
+func logExpiredEntries(allowlist Allowlist, now time.Time, l *logger.Logger) {
+	for _, entry := range allowlist.GlobalPackages {
+		if entry.Expired(now) {
+			l.Warningf("Global allowlist entry %s expired on %s and no longer suppresses findings", entry, entry.Expires)
+		}
+	}
+	for container, entries := range allowlist.ComponentPackages {
+		for _, entry := range entries {
+			if entry.Expired(now) {
+				l.Warningf("Allowlist entry %s for %s expired on %s and no longer suppresses findings", entry, container, entry.Expires)
+			}
+		}
 	}
-	return false, "none"
 }
 
 // allowlistParser is a helper function of CreateAllowlist that unmarshals a []byte into an Allowlist and then returns
-// that allowlist and an error
+// that allowlist and an error. Errors always state the line they are on (if it can be determined).
 func allowlistParser(data []byte) (Allowlist, error) {
 
 	al := new(Allowlist)
 
-	err := yaml.Unmarshal(data, al)
+	// Decode via a yaml.Node so errors in container keys can refer to the line of the key.
+	document := yaml.Node{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return *al, err
+	}
+	if document.Kind != 0 {
+		if err := document.Decode(al); err != nil {
+			return *al, withLineNumber(err)
+		}
+	}
+
+	// Compile container keys once, plain keys have to match the container name exactly.
+	al.containerPatterns = make(map[string]*regexp.Regexp)
+	for key := range al.ComponentPackages {
+		var err error
+		al.containerPatterns[key], err = compilePattern(key, false)
+		if err != nil {
+			return *al, withLineNumber(allowlistEntryError{containerKeyNode(&document, key),
+				fmt.Errorf("container_allowlist key %s is not a valid pattern: %v", key, err)})
+		}
+	}
+	return *al, nil
+}
 
-	return *al, err
+// withLineNumber prefixes an allowlistEntryError with the line of its node, like the yaml package does for syntax
+// errors. Other errors are returned as is.
+func withLineNumber(err error) error {
+	var entryError allowlistEntryError
+	if !errors.As(err, &entryError) || entryError.node == nil {
+		return err
+	}
+	return fmt.Errorf("yaml: line %d: %v", entryError.node.Line, entryError.err)
+}
+
+// fieldNode returns the value node of a key in a mapping node, or the mapping node itself if it has no such key.
+func fieldNode(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(mapping.Content); i += 2 {
+			if mapping.Content[i].Value == key {
+				return mapping.Content[i+1]
+			}
+		}
+	}
+	return mapping
+}
+
+// containerKeyNode returns the node of a container_allowlist key in an allowlist document, nil if it can not be found.
+func containerKeyNode(document *yaml.Node, key string) *yaml.Node {
+	if document.Kind != yaml.DocumentNode || len(document.Content) == 0 {
+		return nil
+	}
+	containers := fieldNode(document.Content[0], "container_allowlist")
+	if containers.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i < len(containers.Content); i += 2 {
+		if containers.Content[i].Value == key {
+			return containers.Content[i]
+		}
+	}
+	return nil
 }
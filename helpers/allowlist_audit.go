@@ -0,0 +1,95 @@
+package helpers
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Keeps track of which parts of an allowlist are used by the repositories and findings in a registry, so stale
+// exceptions can be cleaned up.
+
+// AllowlistAudit counts how many containers every container key matches and how many findings every entry matches.
+type AllowlistAudit struct {
+	allowlist     *Allowlist
+	containerHits map[string]int   // containerHits: Number of containers matched per container key
+	globalHits    []int            // globalHits: Number of findings matched per global entry
+	componentHits map[string][]int // componentHits: Number of findings matched per container entry, by container key
+}
+
+// NewAllowlistAudit returns an AllowlistAudit for an Allowlist without any recorded containers or findings.
+func NewAllowlistAudit(allowlist *Allowlist) *AllowlistAudit {
+	audit := &AllowlistAudit{
+		allowlist:     allowlist,
+		containerHits: make(map[string]int),
+		globalHits:    make([]int, len(allowlist.GlobalPackages)),
+		componentHits: make(map[string][]int),
+	}
+	for key, entries := range allowlist.ComponentPackages {
+		audit.containerHits[key] = 0
+		audit.componentHits[key] = make([]int, len(entries))
+	}
+	return audit
+}
+
+// RecordContainer records a container (repository name without baseRepo) present in the registry.
+func (a *AllowlistAudit) RecordContainer(c string) {
+	for _, key := range a.allowlist.MatchingContainerKeys(c) {
+		a.containerHits[key]++
+	}
+}
+
+// RecordFinding records a vulnerability in a package ("package@version") found in a container, counting every entry
+// that matches it (not just the first) regardless of whether it expired.
+func (a *AllowlistAudit) RecordFinding(c string, vulnerability string, pkg string) {
+	for i := range a.allowlist.GlobalPackages {
+		if a.allowlist.GlobalPackages[i].Matches(vulnerability, pkg) {
+			a.globalHits[i]++
+		}
+	}
+	for _, key := range a.allowlist.MatchingContainerKeys(c) {
+		entries := a.allowlist.ComponentPackages[key]
+		for i := range entries {
+			if entries[i].Matches(vulnerability, pkg) {
+				a.componentHits[key][i]++
+			}
+		}
+	}
+}
+
+// UnmatchedContainerKeys returns the (sorted) container keys that did not match any recorded container.
+func (a *AllowlistAudit) UnmatchedContainerKeys() (keys []string) {
+	for key, hits := range a.containerHits {
+		if hits == 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// UnusedEntries returns the entries that did not match any recorded finding, each with its Scope set. Global entries
+// are returned first, followed by container entries sorted by container key.
+func (a *AllowlistAudit) UnusedEntries() (entries []AllowlistEntry) {
+	for i, hits := range a.globalHits {
+		if hits == 0 {
+			entry := a.allowlist.GlobalPackages[i]
+			entry.Scope = "global"
+			entries = append(entries, entry)
+		}
+	}
+	var keys []string
+	for key := range a.componentHits {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for i, hits := range a.componentHits[key] {
+			if hits == 0 {
+				entry := a.allowlist.ComponentPackages[key][i]
+				entry.Scope = fmt.Sprintf("container %s", key)
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
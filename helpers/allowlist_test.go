@@ -0,0 +1,327 @@
+package helpers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseEntry unmarshals a single (plain or structured) AllowlistEntry from yaml.
+func parseEntry(t *testing.T, entry string) AllowlistEntry {
+	t.Helper()
+	e := AllowlistEntry{}
+	if err := yaml.Unmarshal([]byte(entry), &e); err != nil {
+		t.Fatalf("failed to parse allowlist entry %s: %v", entry, err)
+	}
+	return e
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob     string
+		expected string
+	}{
+		{"linux-*", `linux-.*`},
+		{"lib?", `lib.`},
+		{"libssl1.[01]", `libssl1\.[01]`},
+		{"lib[!c]*", `lib[^c].*`},
+		{"lib[a", `lib\[a`},
+		{`x[\]`, `x[\\]`},
+	}
+	for _, test := range tests {
+		if expression := globToRegexp(test.glob); expression != test.expected {
+			t.Errorf("globToRegexp(%q) = %q, expected %q", test.glob, expression, test.expected)
+		}
+	}
+}
+
+func TestCompilePattern(t *testing.T) {
+	tests := []struct {
+		pattern     string
+		prefixMatch bool
+		value       string
+		matches     bool
+	}{
+		// Plain patterns, either as a prefix or exactly.
+		{"linux@4.9", true, "linux@4.9.1", true},
+		{"linux@4.9", true, "linux-libc@4.9.1", false},
+		{"linux@4.9", false, "linux@4.9.1", false},
+		{"jenkins", false, "jenkins", true},
+		{"jenkins", false, "jenkins-agent", false},
+		{"a.b", true, "axb", false},
+		// Globs have to match completely, regardless of prefixMatch.
+		{"linux-*", true, "linux-libc@4.9.1", true},
+		{"linux-*@4.9", true, "linux-libc@4.9.1", false},
+		{"zd-*", false, "zd-api", true},
+		{"zd-*", false, "team/zd-api", false},
+		{"*/zd-*", false, "team/zd-api", true},
+		{"lib?@1", true, "libc@1", true},
+		{"lib?@1", true, "libcc@1", false},
+		{"libssl1.[01]@*", true, "libssl1.1@1.1.0", true},
+		{"libssl1.[01]@*", true, "libssl1.2@1.1.0", false},
+		{"libssl1.[!01]@*", true, "libssl1.2@1.1.0", true},
+		// Regular expressions match anywhere unless anchored.
+		{`re:^libssl1\.[01]@`, true, "libssl1.0@1.0.2", true},
+		{`re:^libssl1\.[01]@`, true, "xlibssl1.0@1.0.2", false},
+		{`re:ssl`, false, "libssl@1.1", true},
+		{`re:^zd-(api|web)$`, false, "zd-web", true},
+		{`re:^zd-(api|web)$`, false, "zd-worker", false},
+	}
+	for _, test := range tests {
+		expression, err := compilePattern(test.pattern, test.prefixMatch)
+		if err != nil {
+			t.Fatalf("compilePattern(%q) returned an error: %v", test.pattern, err)
+		}
+		if matches := expression.MatchString(test.value); matches != test.matches {
+			t.Errorf("compilePattern(%q, %v) matches %q = %v, expected %v", test.pattern, test.prefixMatch, test.value, matches, test.matches)
+		}
+	}
+
+	if _, err := compilePattern("re:libssl(", true); err == nil {
+		t.Errorf("expected an error for an invalid regular expression")
+	}
+}
+
+func TestAllowlistEntryMatches(t *testing.T) {
+	tests := []struct {
+		entry         string
+		vulnerability string
+		pkg           string
+		matches       bool
+	}{
+		// Plain packages are a prefix.
+		{"openssl", "CVE-2019-1", "openssl@1.1.0", true},
+		{"openssl@1.1", "CVE-2019-1", "openssl@1.1.0", true},
+		{"openssl@1.1", "CVE-2019-1", "openssl@1.0.2", false},
+		{"{package: openssl, version: '1.1'}", "CVE-2019-1", "openssl@1.1.0", true},
+		// Globs match completely, except for their version.
+		{"linux-*", "CVE-2019-1", "linux-libc@4.9.1", true},
+		{"linux-*@4.9", "CVE-2019-1", "linux-libc@4.9.1", true},
+		{"linux-*@4.9", "CVE-2019-1", "linux-libc@4.10", false},
+		{"{package: 'linux-*', version: '4.9'}", "CVE-2019-1", "linux-libc@4.9.1", true},
+		{"{package: 'linux-*', version: '4.9'}", "CVE-2019-1", "linux-libc@4.10", false},
+		{"lib*@1.[01]", "CVE-2019-1", "libssl@1.1.0k", true},
+		{"lib*@1.[01]", "CVE-2019-1", "libssl@1.2.0", false},
+		{"'*ssl'", "CVE-2019-1", "libssl@1.1.0", false},
+		// Regular expressions.
+		{`re:^libssl1\.[01]@`, "CVE-2019-1", "libssl1.1@1.1.0", true},
+		{`re:^libssl1\.[01]@`, "CVE-2019-1", "libssl1.2@1.1.0", false},
+		{`re:@1\.1\.`, "CVE-2019-1", "openssl@1.1.0", true},
+		// CVEs match in any case, optionally only in a package.
+		{"CVE-2019-1", "CVE-2019-1", "openssl@1.1.0", true},
+		{"cve-2019-1", "CVE-2019-1", "openssl@1.1.0", true},
+		{"CVE-2019-1", "CVE-2019-10", "openssl@1.1.0", false},
+		{"{cve: cve-2019-1, package: openssl}", "CVE-2019-1", "openssl@1.1.0", true},
+		{"{cve: CVE-2019-1, package: openssl}", "CVE-2019-1", "bash@5.0", false},
+		{"{cve: CVE-2019-1, package: openssl}", "CVE-2019-2", "openssl@1.1.0", false},
+		// Only CVE identifiers are CVE rules as plain strings, anything else is a package.
+		{"cve-tools", "CVE-2019-1", "cve-tools@1.0", true},
+		{"cve-tools", "CVE-2019-1", "openssl@1.1.0", false},
+		{"CVE-2019", "CVE-2019-1", "CVE-2019-tools@1.0", true},
+		{"ALAS2-2019-1234", "ALAS2-2019-1234", "openssl@1.1.0", false},
+		{"{cve: ALAS2-2019-1234}", "ALAS2-2019-1234", "openssl@1.1.0", true},
+	}
+	for _, test := range tests {
+		entry := parseEntry(t, test.entry)
+		if matches := entry.Matches(test.vulnerability, test.pkg); matches != test.matches {
+			t.Errorf("%s matches %s in %s = %v, expected %v", test.entry, test.vulnerability, test.pkg, matches, test.matches)
+		}
+	}
+}
+
+func TestInAllowList(t *testing.T) {
+	day := func(d int, hour int) time.Time {
+		return time.Date(2020, 1, d, hour, 0, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name     string
+		entries  []string
+		severity string
+		now      time.Time
+		found    bool
+		hit      int // hit: Index of the entry returned, -1 for none
+	}{
+		{name: "no entries", severity: "HIGH", now: day(1, 0), hit: -1},
+		{name: "no match", entries: []string{"bash", "CVE-2019-2"}, severity: "HIGH", now: day(1, 0), hit: -1},
+		{name: "first match", entries: []string{"bash", "openssl", "CVE-2019-1"}, severity: "HIGH", now: day(1, 0), found: true, hit: 1},
+		{name: "before expiry day", entries: []string{"{package: openssl, expires: 2020-01-31}"}, severity: "HIGH", now: day(30, 12), found: true, hit: 0},
+		{name: "on expiry day", entries: []string{"{package: openssl, expires: 2020-01-31}"}, severity: "HIGH", now: day(31, 23), found: true, hit: 0},
+		{name: "after expiry day", entries: []string{"{package: openssl, expires: 2020-01-31}"}, severity: "HIGH", now: day(32, 0), hit: 0},
+		{name: "expired entry falls through", entries: []string{"{package: openssl, expires: 2020-01-01}", "CVE-2019-1"}, severity: "HIGH", now: day(2, 0), found: true, hit: 1},
+		{name: "below max severity", entries: []string{"{package: openssl, max_severity: medium}"}, severity: "LOW", now: day(1, 0), found: true, hit: 0},
+		{name: "at max severity", entries: []string{"{package: openssl, max_severity: MEDIUM}"}, severity: "MEDIUM", now: day(1, 0), found: true, hit: 0},
+		{name: "above max severity", entries: []string{"{package: openssl, max_severity: MEDIUM}"}, severity: "HIGH", now: day(1, 0), hit: 0},
+		{name: "informational cap", entries: []string{"{package: openssl, max_severity: INFORMATIONAL}"}, severity: "LOW", now: day(1, 0), hit: 0},
+		{name: "undefined severity with cap", entries: []string{"{package: openssl, max_severity: CRITICAL}"}, severity: "UNDEFINED", now: day(1, 0), hit: 0},
+		{name: "undefined severity without cap", entries: []string{"openssl"}, severity: "UNDEFINED", now: day(1, 0), found: true, hit: 0},
+		{name: "first rejected entry", entries: []string{"{package: openssl, max_severity: LOW}", "{cve: CVE-2019-1, expires: 2019-12-31}"}, severity: "HIGH", now: day(1, 0), hit: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var list []AllowlistEntry
+			for _, entry := range test.entries {
+				list = append(list, parseEntry(t, entry))
+			}
+			found, hit := InAllowList(list, "CVE-2019-1", "openssl@1.1.0", test.severity, test.now)
+			if found != test.found {
+				t.Errorf("expected found = %v, got %v", test.found, found)
+			}
+			expected := AllowlistEntry{}
+			if test.hit >= 0 {
+				expected = list[test.hit]
+			}
+			if hit.String() != expected.String() || hit.Expires != expected.Expires || hit.MaxSeverity != expected.MaxSeverity {
+				t.Errorf("expected hit %s, got %s", expected, hit)
+			}
+		})
+	}
+}
+
+func TestFlattenAllowlist(t *testing.T) {
+	allowlist, err := allowlistParser([]byte(`global_allowlist:
+  - openssl
+container_allowlist:
+  jenkins:
+    - systemd
+  "jenkins*":
+    - glibc
+  "re:^zd-(api|web)$":
+    - busybox
+`))
+	if err != nil {
+		t.Fatalf("allowlistParser returned an error: %v", err)
+	}
+	tests := []struct {
+		container string
+		expected  []string
+	}{
+		{"jenkins", []string{"global openssl", "container jenkins systemd", "container jenkins* glibc"}},
+		{"jenkins-agent", []string{"global openssl", "container jenkins* glibc"}},
+		{"zd-web", []string{"global openssl", "container re:^zd-(api|web)$ busybox"}},
+		{"zd-worker", []string{"global openssl"}},
+	}
+	for _, test := range tests {
+		var entries []string
+		for _, entry := range FlattenAllowlist(&allowlist, test.container) {
+			entries = append(entries, entry.Scope+" "+entry.String())
+		}
+		if strings.Join(entries, ", ") != strings.Join(test.expected, ", ") {
+			t.Errorf("FlattenAllowlist(%s) = %v, expected %v", test.container, entries, test.expected)
+		}
+	}
+}
+
+func TestAllowlistParserErrorLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		expected string
+	}{
+		{
+			name: "value used more than once",
+			yaml: `global_allowlist:
+  - CVE-2019-1
+container_allowlist:
+  jenkins:
+    - {cve: CVE-2019-1, version: '1.0'}
+`,
+			expected: "yaml: line 5: allowlist entry for CVE-2019-1 has a version but no package",
+		},
+		{
+			name: "invalid max_severity",
+			yaml: `global_allowlist:
+  - package: bash
+    max_severity: HIGH
+  - package: bash
+    max_severity: hihg
+`,
+			expected: "yaml: line 5: allowlist entry bash has an invalid max_severity hihg",
+		},
+		{
+			name: "invalid expires of a cve entry",
+			yaml: `global_allowlist:
+  - cve: CVE-2019-1
+    expires: 2020-01-01
+  - cve: CVE-2019-1
+    expires: 01-01-2020
+`,
+			expected: "yaml: line 5: allowlist entry CVE-2019-1 has an invalid expires date",
+		},
+		{
+			name: "entry without package or cve",
+			yaml: `global_allowlist:
+  - openssl
+  - max_severity: LOW
+`,
+			expected: "yaml: line 3: allowlist entry without package or cve",
+		},
+		{
+			name: "invalid plain pattern",
+			yaml: `global_allowlist:
+  - openssl
+  - re:openssl(
+`,
+			expected: "yaml: line 3: allowlist entry re:openssl( is not a valid pattern",
+		},
+		{
+			name: "invalid container key",
+			yaml: `global_allowlist:
+  - {package: openssl, reason: "not for re:jenkins("}
+container_allowlist:
+  jenkins:
+    - openssl
+  re:jenkins(:
+    - openssl
+`,
+			expected: "yaml: line 6: container_allowlist key re:jenkins( is not a valid pattern",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := allowlistParser([]byte(test.yaml))
+			if err == nil {
+				t.Fatalf("expected an error starting with %q", test.expected)
+			}
+			if !strings.HasPrefix(err.Error(), test.expected) {
+				t.Errorf("expected an error starting with %q, got %q", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestAllowlistParser(t *testing.T) {
+	allowlist, err := allowlistParser([]byte(`global_allowlist:
+  - openssl@1.1
+  - CVE-2019-1
+  - {package: bash, cve: CVE-2019-2, max_severity: low, expires: 2020-01-31}
+container_allowlist:
+  jenkins:
+    - systemd
+  "jenkins-*":
+    - glibc
+`))
+	if err != nil {
+		t.Fatalf("allowlistParser returned an error: %v", err)
+	}
+	if len(allowlist.GlobalPackages) != 3 || len(allowlist.ComponentPackages) != 2 {
+		t.Fatalf("unexpected allowlist %+v", allowlist)
+	}
+	kinds := []string{AllowlistRulePackage, AllowlistRuleCVE, AllowlistRuleCVEPackage}
+	for i, entry := range allowlist.GlobalPackages {
+		if entry.Kind() != kinds[i] {
+			t.Errorf("expected entry %s to be a %s rule, got %s", entry, kinds[i], entry.Kind())
+		}
+	}
+	if severity := allowlist.GlobalPackages[2].MaxSeverity; severity != "LOW" {
+		t.Errorf("expected max_severity LOW, got %s", severity)
+	}
+	if keys := allowlist.MatchingContainerKeys("jenkins-agent"); len(keys) != 1 || keys[0] != "jenkins-*" {
+		t.Errorf("expected jenkins-agent to match jenkins-*, got %v", keys)
+	}
+
+	if _, err := allowlistParser(nil); err != nil {
+		t.Errorf("expected an empty allowlist to parse, got %v", err)
+	}
+}
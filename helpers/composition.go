@@ -0,0 +1,382 @@
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/google/logger"
+	"gopkg.in/yaml.v2"
+)
+
+// Contains the parsers for the composition formats supported by report composition.
+
+// Composition formats accepted by CompositionParser.
+const (
+	CompositionFormatZD            = "zd"             // CompositionFormatZD: ZorgDomein's flat name_version: TAG map
+	CompositionFormatDockerCompose = "docker-compose" // CompositionFormatDockerCompose: Docker compose file, using services.*.image
+	CompositionFormatKubernetes    = "kubernetes"     // CompositionFormatKubernetes: (Multi document) Kubernetes manifests, e.g. the output of helm template
+	CompositionFormatECS           = "ecs"            // CompositionFormatECS: ECS task definition json, using containerDefinitions[].image
+	CompositionFormatImageList     = "image-list"     // CompositionFormatImageList: Plain list of image URIs, one per line
+)
+
+// ecrImageURIPattern matches ECR image URIs, capturing the registry (account) id, region, repository, tag and digest.
+var ecrImageURIPattern = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?/([^:@]+)(?::([^@]+))?(?:@(sha256:[a-f0-9]{64}))?$`)
+
+// composeVariablePattern matches ${VARIABLE}, ${VARIABLE:-default} and ${VARIABLE-default} in docker compose files.
+var composeVariablePattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?:(:?-)([^}]*))?\}`)
+
+// EcrImageReference contains the parts of an ECR image URI.
+type EcrImageReference struct {
+	RegistryID string // RegistryID: AWS account id of the registry
+	Region     string // Region: AWS region of the registry
+	Repository string // Repository: Name of the repository
+	Tag        string // Tag: Tag of the image, empty if the URI only has a digest (or neither)
+	Digest     string // Digest: Digest (sha256:<hash>) of the image, empty if the URI has none
+}
+
+// dockerCompose contains the parts of a docker compose file we use.
+type dockerCompose struct {
+	Services map[string]struct {
+		Image string `yaml:"image"`
+	} `yaml:"services"`
+}
+
+// kubernetesManifest contains the parts of a Kubernetes manifest we use to find the pod spec of workloads. Lists (as
+// returned by kubectl get -o yaml) contain manifests in Items. Only the kind is decoded for other resources, so these
+// (like custom resources) can have any shape.
+type kubernetesManifest struct {
+	Kind  string
+	Spec  kubernetesWorkloadSpec
+	Items []kubernetesManifest
+}
+
+// kubernetesWorkloadSpec contains the pod spec of a Pod, the pod template of workloads and the job template of CronJobs.
+type kubernetesWorkloadSpec struct {
+	kubernetesPodSpec `yaml:",inline"`
+	Template          kubernetesPodTemplate `yaml:"template"`
+	JobTemplate       struct {
+		Spec struct {
+			Template kubernetesPodTemplate `yaml:"template"`
+		} `yaml:"spec"`
+	} `yaml:"jobTemplate"`
+}
+
+// kubernetesWorkloadKinds are the kinds kubernetesImages finds the pod spec of.
+var kubernetesWorkloadKinds = map[string]bool{
+	"Pod": true, "Deployment": true, "StatefulSet": true, "DaemonSet": true, "ReplicaSet": true,
+	"ReplicationController": true, "Job": true, "CronJob": true,
+}
+
+// UnmarshalYAML decodes the kind of a kubernetesManifest first, and only decodes the spec of workloads and the items of
+// Lists.
+func (m *kubernetesManifest) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var header struct {
+		Kind string `yaml:"kind"`
+	}
+	if err := unmarshal(&header); err != nil {
+		return err
+	}
+	m.Kind = header.Kind
+	switch {
+	case m.Kind == "List":
+		var list struct {
+			Items []kubernetesManifest `yaml:"items"`
+		}
+		err := unmarshal(&list)
+		m.Items = list.Items
+		return err
+	case kubernetesWorkloadKinds[m.Kind]:
+		var workload struct {
+			Spec kubernetesWorkloadSpec `yaml:"spec"`
+		}
+		err := unmarshal(&workload)
+		m.Spec = workload.Spec
+		return err
+	}
+	return nil
+}
+
+// kubernetesPodTemplate contains the pod spec of a workload.
+type kubernetesPodTemplate struct {
+	Spec kubernetesPodSpec `yaml:"spec"`
+}
+
+// kubernetesPodSpec contains the (init) containers of a pod.
+type kubernetesPodSpec struct {
+	InitContainers []kubernetesContainer `yaml:"initContainers"`
+	Containers     []kubernetesContainer `yaml:"containers"`
+}
+
+// kubernetesContainer contains the image of a container.
+type kubernetesContainer struct {
+	Image string `yaml:"image"`
+}
+
+// ecsTaskDefinition contains the parts of an ECS task definition we use. Output of describe-task-definition wraps the
+// task definition in TaskDefinition, input of register-task-definition does not.
+type ecsTaskDefinition struct {
+	TaskDefinition *ecsTaskDefinition `json:"taskDefinition"`
+	Containers     []ecsContainer     `json:"containerDefinitions"`
+}
+
+// ecsContainer contains the image of a container definition.
+type ecsContainer struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+// CompositionParser reads a composition file in one of the CompositionFormat formats and converts its entries into a
+// list of generic container objects that can be used as input when interacting with the ECR endpoints. It takes a
+// pointer to a CompositionConfig and a registry id and returns the images sorted by name and an error.
+// A CompositionFileName of "-" reads the composition from stdin.
+func CompositionParser(s *CompositionConfig, r *string, l *logger.Logger) (imageList []ecr.Image, err error) {
+	var data []byte
+	if s.CompositionFileName == "-" {
+		l.Info("trying to read composition from stdin")
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = fileReader(s.CompositionFileName, l)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %v", s.CompositionFileName, err)
+	}
+
+	l.Infof("unmarshalling contents of %s as %s composition", s.CompositionFileName, s.Format)
+	switch s.Format {
+	case CompositionFormatDockerCompose:
+		imageList, err = dockerComposeParser(data, s, r, l)
+	case CompositionFormatKubernetes:
+		imageList, err = kubernetesParser(data, s, r, l)
+	case CompositionFormatECS:
+		imageList, err = ecsTaskDefinitionParser(data, s, r, l)
+	case CompositionFormatImageList:
+		imageList, err = imageListParser(data, s, r, l)
+	default:
+		imageList, err = zdCompositionParser(data, s, r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", s.CompositionFileName, err)
+	}
+
+	// Sort images by name since we iterate over maps, keeps output of a run deterministic.
+	sort.SliceStable(imageList, func(i, j int) bool {
+		return FormatImageReference(&imageList[i]) < FormatImageReference(&imageList[j])
+	})
+	return imageList, nil
+}
+
+// zdCompositionParser is a a helper function to massage entries in a ZorgDomein flavoured composition file into a usable
+// format. Keys are massaged into container names using the prefix/suffix settings of the CompositionConfig, values can
+// be either tags or digests (sha256:<hash>).
+// This tailored to ZorgDomein's usecase and may not suit your usecase.
+func zdCompositionParser(data []byte, s *CompositionConfig, r *string) (imageList []ecr.Image, err error) {
+	zdComposition := make(map[string]string)
+	if err = yaml.Unmarshal(data, zdComposition); err != nil {
+		return nil, err
+	}
+
+	for c, v := range zdComposition {
+		c = underscoreHyphenator(suffixStripper(prefixStripper(c, s.StripPrefix), s.StripSuffix))
+		if s.BaseRepo != "" {
+			c = strings.Join([]string{s.BaseRepo, c}, "/")
+		}
+		imageList = append(imageList, NewImageDefinition(r, c, v))
+	}
+	return imageList, nil
+}
+
+// dockerComposeParser extracts the image of every service in a docker compose file, expanding ${VARIABLE} references
+// from the environment. Returns the images that are in ECR.
+func dockerComposeParser(data []byte, s *CompositionConfig, r *string, l *logger.Logger) ([]ecr.Image, error) {
+	compose := dockerCompose{}
+	if err := yaml.Unmarshal(data, &compose); err != nil {
+		return nil, err
+	}
+
+	var uris []string
+	for service, definition := range compose.Services {
+		if definition.Image == "" {
+			l.Infof("Skipping service %s without image", service)
+			continue
+		}
+		uris = append(uris, expandComposeVariables(definition.Image))
+	}
+	return ecrImagesFromURIs(uris, s, r, l), nil
+}
+
+// kubernetesParser extracts the image of every (init) container of the workloads (Pods, Deployments, StatefulSets,
+// DaemonSets, ReplicaSets, Jobs and CronJobs) in a multi document Kubernetes yaml. Returns the images that are in ECR.
+func kubernetesParser(data []byte, s *CompositionConfig, r *string, l *logger.Logger) ([]ecr.Image, error) {
+	var uris []string
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for document := 1; ; document++ {
+		manifest := kubernetesManifest{}
+		err := decoder.Decode(&manifest)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("document %d: %v", document, err)
+		}
+		uris = append(uris, kubernetesImages(manifest)...)
+	}
+	return ecrImagesFromURIs(uris, s, r, l), nil
+}
+
+// kubernetesImages returns the image of every (init) container in a kubernetesManifest, or in every manifest of a List.
+// Returns nothing for kinds that do not contain pods.
+func kubernetesImages(manifest kubernetesManifest) (images []string) {
+	var podSpec kubernetesPodSpec
+	switch manifest.Kind {
+	case "List":
+		for i := range manifest.Items {
+			images = append(images, kubernetesImages(manifest.Items[i])...)
+		}
+		return images
+	case "Pod":
+		podSpec = manifest.Spec.kubernetesPodSpec
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ReplicationController", "Job":
+		podSpec = manifest.Spec.Template.Spec
+	case "CronJob":
+		podSpec = manifest.Spec.JobTemplate.Spec.Template.Spec
+	default:
+		return nil
+	}
+	for _, container := range append(podSpec.InitContainers, podSpec.Containers...) {
+		if container.Image != "" {
+			images = append(images, container.Image)
+		}
+	}
+	return images
+}
+
+// ecsTaskDefinitionParser extracts the image of every container definition in an ECS task definition. Accepts the output
+// of describe-task-definition, the input of register-task-definition and a plain list of container definitions (like
+// the container_definitions of a Terraform aws_ecs_task_definition). Returns the images that are in ECR.
+func ecsTaskDefinitionParser(data []byte, s *CompositionConfig, r *string, l *logger.Logger) ([]ecr.Image, error) {
+	var containers []ecsContainer
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &containers); err != nil {
+			return nil, err
+		}
+	} else {
+		taskDefinition := ecsTaskDefinition{}
+		if err := json.Unmarshal(trimmed, &taskDefinition); err != nil {
+			return nil, err
+		}
+		if taskDefinition.TaskDefinition != nil {
+			taskDefinition = *taskDefinition.TaskDefinition
+		}
+		containers = taskDefinition.Containers
+	}
+
+	var uris []string
+	for _, container := range containers {
+		if container.Image == "" {
+			l.Infof("Skipping container definition %s without image", container.Name)
+			continue
+		}
+		uris = append(uris, container.Image)
+	}
+	return ecrImagesFromURIs(uris, s, r, l), nil
+}
+
+// imageListParser reads a plain list of image URIs, one per line. Empty lines and lines starting with # are ignored.
+// Returns the images that are in ECR.
+func imageListParser(data []byte, s *CompositionConfig, r *string, l *logger.Logger) ([]ecr.Image, error) {
+	var uris []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		uris = append(uris, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ecrImagesFromURIs(uris, s, r, l), nil
+}
+
+// ParseEcrImageURI parses an ECR image URI (<account>.dkr.ecr.<region>.amazonaws.com/<repository>[:tag][@digest]) into
+// an EcrImageReference. Returns false if the URI does not refer to an image in ECR.
+func ParseEcrImageURI(uri string) (reference EcrImageReference, ok bool) {
+	match := ecrImageURIPattern.FindStringSubmatch(strings.TrimSpace(uri))
+	if match == nil {
+		return reference, false
+	}
+	return EcrImageReference{
+		RegistryID: match[1],
+		Region:     match[2],
+		Repository: match[3],
+		Tag:        match[4],
+		Digest:     match[5],
+	}, true
+}
+
+// Image converts an EcrImageReference into an ecr.Image. Digests take precedence over tags, references without either
+// refer to the latest tag like they do for docker.
+func (reference EcrImageReference) Image() ecr.Image {
+	imageReference := reference.Digest
+	if imageReference == "" {
+		imageReference = reference.Tag
+	}
+	if imageReference == "" {
+		imageReference = "latest"
+	}
+	registryID := reference.RegistryID
+	return NewImageDefinition(&registryID, reference.Repository, imageReference)
+}
+
+// ecrImagesFromURIs converts a list of image URIs into ecr.Images, skipping (and logging) URIs that are not in ECR, are
+// in a different region than the CompositionConfig or in a different registry than r (if set). Duplicates are removed.
+func ecrImagesFromURIs(uris []string, s *CompositionConfig, r *string, l *logger.Logger) (imageList []ecr.Image) {
+	seen := make(map[string]bool)
+	for _, uri := range uris {
+		reference, ok := ParseEcrImageURI(uri)
+		if !ok {
+			l.Infof("Skipping %s, not an ECR image", uri)
+			continue
+		}
+		if s.Region != "" && reference.Region != s.Region {
+			l.Warningf("Skipping %s, it is in region %s instead of %s", uri, reference.Region, s.Region)
+			continue
+		}
+		if r != nil && *r != "" && reference.RegistryID != *r {
+			l.Warningf("Skipping %s, it is in registry %s instead of %s", uri, reference.RegistryID, *r)
+			continue
+		}
+		image := reference.Image()
+		if n := FormatImageReference(&image); !seen[n] {
+			seen[n] = true
+			imageList = append(imageList, image)
+		}
+	}
+	return imageList
+}
+
+// expandComposeVariables replaces ${VARIABLE}, ${VARIABLE:-default} and ${VARIABLE-default} with their value in the
+// environment the way docker compose does. ':-' uses the default for unset and empty variables, '-' only for unset ones.
+func expandComposeVariables(value string) string {
+	return composeVariablePattern.ReplaceAllStringFunc(value, func(variable string) string {
+		match := composeVariablePattern.FindStringSubmatch(variable)
+		environmentValue, set := os.LookupEnv(match[1])
+		switch {
+		case match[2] == ":-" && environmentValue == "":
+			return match[3]
+		case match[2] == "-" && !set:
+			return match[3]
+		default:
+			return environmentValue
+		}
+	})
+}
@@ -0,0 +1,286 @@
+package helpers
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/google/logger"
+)
+
+const (
+	testRegistry = "123456789012"
+	testDigest   = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+)
+
+// formatImages returns the registry and FormatImageReference of every image, to compare parser output in one go.
+func formatImages(images []ecr.Image) (references []string) {
+	for i := range images {
+		references = append(references, aws.StringValue(images[i].RegistryId)+" "+FormatImageReference(&images[i]))
+	}
+	return references
+}
+
+// expectImages fails a test when images (in order) are not the expected "registry repository[:tag][@digest]" references.
+func expectImages(t *testing.T, images []ecr.Image, expected ...string) {
+	t.Helper()
+	if references := formatImages(images); strings.Join(references, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("expected images %v, got %v", expected, references)
+	}
+}
+
+func TestParseEcrImageURI(t *testing.T) {
+	tests := []struct {
+		uri       string
+		ok        bool
+		reference EcrImageReference
+	}{
+		{
+			uri:       "123456789012.dkr.ecr.eu-west-1.amazonaws.com/jenkins:2.204.1",
+			ok:        true,
+			reference: EcrImageReference{RegistryID: testRegistry, Region: "eu-west-1", Repository: "jenkins", Tag: "2.204.1"},
+		},
+		{
+			uri:       "123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/jenkins@" + testDigest,
+			ok:        true,
+			reference: EcrImageReference{RegistryID: testRegistry, Region: "eu-west-1", Repository: "team/jenkins", Digest: testDigest},
+		},
+		{
+			uri:       "123456789012.dkr.ecr.eu-west-1.amazonaws.com/jenkins:2.204.1@" + testDigest,
+			ok:        true,
+			reference: EcrImageReference{RegistryID: testRegistry, Region: "eu-west-1", Repository: "jenkins", Tag: "2.204.1", Digest: testDigest},
+		},
+		{
+			uri:       "123456789012.dkr.ecr.eu-west-1.amazonaws.com/jenkins",
+			ok:        true,
+			reference: EcrImageReference{RegistryID: testRegistry, Region: "eu-west-1", Repository: "jenkins"},
+		},
+		{
+			uri:       "123456789012.dkr.ecr-fips.us-east-1.amazonaws.com/jenkins:lts",
+			ok:        true,
+			reference: EcrImageReference{RegistryID: testRegistry, Region: "us-east-1", Repository: "jenkins", Tag: "lts"},
+		},
+		{
+			uri:       "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn/jenkins:lts",
+			ok:        true,
+			reference: EcrImageReference{RegistryID: testRegistry, Region: "cn-north-1", Repository: "jenkins", Tag: "lts"},
+		},
+		{
+			uri:       "  123456789012.dkr.ecr.eu-west-1.amazonaws.com/jenkins:lts ",
+			ok:        true,
+			reference: EcrImageReference{RegistryID: testRegistry, Region: "eu-west-1", Repository: "jenkins", Tag: "lts"},
+		},
+		{uri: "jenkins/jenkins:lts"},
+		{uri: "docker.io/library/redis:5"},
+		{uri: "public.ecr.aws/nginx/nginx:1.19"},
+		{uri: "12345678901.dkr.ecr.eu-west-1.amazonaws.com/jenkins:lts"},
+		{uri: "123456789012.dkr.ecr.eu-west-1.amazonaws.com/jenkins@sha256:abc"},
+		{uri: "123456789012.dkr.ecr.eu-west-1.amazonaws.com.evil.com/jenkins:lts"},
+	}
+	for _, test := range tests {
+		reference, ok := ParseEcrImageURI(test.uri)
+		if ok != test.ok {
+			t.Errorf("ParseEcrImageURI(%q) ok = %v, expected %v", test.uri, ok, test.ok)
+		} else if reference != test.reference {
+			t.Errorf("ParseEcrImageURI(%q) = %+v, expected %+v", test.uri, reference, test.reference)
+		}
+	}
+}
+
+func TestEcrImagesFromURIs(t *testing.T) {
+	uris := []string{
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com/jenkins:2.204.1",
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com/jenkins:2.204.1",
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com/jenkins:lts@" + testDigest,
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com/redis",
+		"123456789012.dkr.ecr.us-east-1.amazonaws.com/nginx:1.19",
+		"210987654321.dkr.ecr.eu-west-1.amazonaws.com/postgres:12",
+		"redis:5",
+	}
+	l := logger.Init("test", false, false, ioutil.Discard)
+
+	images := ecrImagesFromURIs(uris, &CompositionConfig{Region: "eu-west-1"}, aws.String(testRegistry), l)
+	expectImages(t, images,
+		testRegistry+" jenkins:2.204.1",
+		testRegistry+" jenkins@"+testDigest,
+		testRegistry+" redis:latest",
+	)
+
+	// Without a region and registry only images outside of ECR are skipped.
+	images = ecrImagesFromURIs(uris, &CompositionConfig{}, nil, l)
+	expectImages(t, images,
+		testRegistry+" jenkins:2.204.1",
+		testRegistry+" jenkins@"+testDigest,
+		testRegistry+" redis:latest",
+		testRegistry+" nginx:1.19",
+		"210987654321 postgres:12",
+	)
+}
+
+func TestExpandComposeVariables(t *testing.T) {
+	variables := map[string]*string{
+		"ESU_TEST_SET":   aws.String("1.0"),
+		"ESU_TEST_EMPTY": aws.String(""),
+		"ESU_TEST_UNSET": nil,
+	}
+	for name, value := range variables {
+		previous, set := os.LookupEnv(name)
+		if value == nil {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, *value)
+		}
+		defer func(name string) {
+			if set {
+				os.Setenv(name, previous)
+			} else {
+				os.Unsetenv(name)
+			}
+		}(name)
+	}
+
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"jenkins:${ESU_TEST_SET}", "jenkins:1.0"},
+		{"jenkins:${ESU_TEST_EMPTY}", "jenkins:"},
+		{"jenkins:${ESU_TEST_UNSET}", "jenkins:"},
+		{"jenkins:${ESU_TEST_SET:-lts}", "jenkins:1.0"},
+		{"jenkins:${ESU_TEST_EMPTY:-lts}", "jenkins:lts"},
+		{"jenkins:${ESU_TEST_UNSET:-lts}", "jenkins:lts"},
+		{"jenkins:${ESU_TEST_SET-lts}", "jenkins:1.0"},
+		{"jenkins:${ESU_TEST_EMPTY-lts}", "jenkins:"},
+		{"jenkins:${ESU_TEST_UNSET-lts}", "jenkins:lts"},
+		{"${ESU_TEST_UNSET:-123456789012}.dkr.ecr.eu-west-1.amazonaws.com/jenkins:${ESU_TEST_SET}", "123456789012.dkr.ecr.eu-west-1.amazonaws.com/jenkins:1.0"},
+		{"jenkins:$ESU_TEST_SET", "jenkins:$ESU_TEST_SET"},
+	}
+	for _, test := range tests {
+		if expanded := expandComposeVariables(test.value); expanded != test.expected {
+			t.Errorf("expandComposeVariables(%q) = %q, expected %q", test.value, expanded, test.expected)
+		}
+	}
+}
+
+func TestKubernetesParser(t *testing.T) {
+	manifests := `# Source: chart/templates/NOTES.txt
+---
+# only a comment
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: jenkins
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: init
+          image: 123456789012.dkr.ecr.eu-west-1.amazonaws.com/busybox:1.31
+      containers:
+        - name: jenkins
+          image: 123456789012.dkr.ecr.eu-west-1.amazonaws.com/jenkins:2.204.1
+        - name: sidecar
+          image: docker.io/library/nginx:1.19
+---
+apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: backup
+spec:
+  schedule: "0 3 * * *"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - name: backup
+              image: 123456789012.dkr.ecr.eu-west-1.amazonaws.com/backup@` + testDigest + `
+---
+apiVersion: v1
+kind: List
+items:
+  - apiVersion: v1
+    kind: Pod
+    metadata:
+      name: redis
+    spec:
+      containers:
+        - name: redis
+          image: 123456789012.dkr.ecr.eu-west-1.amazonaws.com/redis:5
+  - apiVersion: apps/v1
+    kind: StatefulSet
+    spec:
+      template:
+        spec:
+          containers:
+            - name: jenkins
+              image: 123456789012.dkr.ecr.eu-west-1.amazonaws.com/jenkins:2.204.1
+---
+apiVersion: v1
+kind: ConfigMap
+data:
+  image: 123456789012.dkr.ecr.eu-west-1.amazonaws.com/configmap:1
+---
+apiVersion: example.com/v1
+kind: Workflow
+spec:
+  containers: "not a list"
+  template: 42
+---
+apiVersion: v1
+kind: Service
+spec:
+  ports:
+    - port: 80
+`
+	l := logger.Init("test", false, false, ioutil.Discard)
+	images, err := kubernetesParser([]byte(manifests), &CompositionConfig{Region: "eu-west-1"}, aws.String(testRegistry), l)
+	if err != nil {
+		t.Fatalf("kubernetesParser returned an error: %v", err)
+	}
+	expectImages(t, images,
+		testRegistry+" busybox:1.31",
+		testRegistry+" jenkins:2.204.1",
+		testRegistry+" backup@"+testDigest,
+		testRegistry+" redis:5",
+	)
+
+	if _, err := kubernetesParser([]byte("kind: Pod\n---\nkind: [Pod\n"), &CompositionConfig{}, nil, l); err == nil || !strings.HasPrefix(err.Error(), "document 2:") {
+		t.Errorf("expected an error for document 2, got %v", err)
+	}
+}
+
+func TestEcsTaskDefinitionParser(t *testing.T) {
+	containerDefinitions := `[
+		{"name": "jenkins", "image": "123456789012.dkr.ecr.eu-west-1.amazonaws.com/jenkins:2.204.1"},
+		{"name": "envoy", "image": "840364872350.dkr.ecr.eu-west-1.amazonaws.com/aws-appmesh-envoy:v1.12.2.1-prod"},
+		{"name": "log-router", "image": "amazon/aws-for-fluent-bit:latest"},
+		{"name": "empty"}
+	]`
+	tests := []struct {
+		name           string
+		taskDefinition string
+	}{
+		{name: "describe-task-definition", taskDefinition: `{"taskDefinition": {"family": "jenkins", "containerDefinitions": ` + containerDefinitions + `}}`},
+		{name: "register-task-definition", taskDefinition: `{"family": "jenkins", "containerDefinitions": ` + containerDefinitions + `}`},
+		{name: "container definitions", taskDefinition: "\n  " + containerDefinitions},
+	}
+	l := logger.Init("test", false, false, ioutil.Discard)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			images, err := ecsTaskDefinitionParser([]byte(test.taskDefinition), &CompositionConfig{Region: "eu-west-1"}, aws.String(testRegistry), l)
+			if err != nil {
+				t.Fatalf("ecsTaskDefinitionParser returned an error: %v", err)
+			}
+			expectImages(t, images, testRegistry+" jenkins:2.204.1")
+		})
+	}
+
+	if _, err := ecsTaskDefinitionParser([]byte(`{"containerDefinitions": {}}`), &CompositionConfig{}, nil, l); err == nil {
+		t.Errorf("expected an error for invalid container definitions")
+	}
+}
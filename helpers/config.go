@@ -0,0 +1,219 @@
+package helpers
+
+import (
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Handles the (optional) yaml configuration file. Values in the file are used as defaults for flags, so flags and
+// environment variables still override them.
+
+// Config is a target struct we populate with values based on a configuration yaml (see README.MD for format). Fields
+// mirror the flags of the commands they belong to.
+type Config struct {
+	RegistryID      string        `yaml:"registry_id"`
+	BaseRepo        string        `yaml:"base_repo"`
+	Region          string        `yaml:"region"`
+	LatestTag       *bool         `yaml:"latest_tag"`
+	LatestTagFilter string        `yaml:"latest_tag_filter"`
+	TagInclude      []string      `yaml:"tag_include"`
+	TagExclude      []string      `yaml:"tag_exclude"`
+	TagOverrides    []TagOverride `yaml:"tag_overrides"`
+	LatestStrategy  string        `yaml:"latest_strategy"`
+	LatestRegex     string        `yaml:"latest_strategy_regex"`
+	MaxRetries      *int          `yaml:"max_retries"`
+	Verbose         *bool         `yaml:"verbose"`
+	Report          ReportConfig  `yaml:"report"`
+}
+
+// TagOverride replaces the tag include and exclude patterns for repositories (name without base_repo) matching a
+// literal name, glob or regular expression (prefixed with re:).
+type TagOverride struct {
+	Repository string   `yaml:"repository"`
+	TagInclude []string `yaml:"tag_include"`
+	TagExclude []string `yaml:"tag_exclude"`
+}
+
+// ReportConfig contains the settings of the report command and its subcommands.
+type ReportConfig struct {
+	OutputDir           string                      `yaml:"output_dir"`
+	Allowlist           string                      `yaml:"allowlist"`
+	Cutoff              string                      `yaml:"cutoff"`
+	FailOn              []string                    `yaml:"fail_on"`
+	Concurrency         *int                        `yaml:"concurrency"`
+	LatestCount         *int                        `yaml:"latest_count"`
+	PushedWithin        string                      `yaml:"pushed_within"`
+	StartScan           *bool                       `yaml:"start_scan"`
+	ScanTimeout         string                      `yaml:"scan_timeout"`
+	ScanPollInterval    string                      `yaml:"scan_poll_interval"`
+	ScanMaxPollInterval string                      `yaml:"scan_max_poll_interval"`
+	Reporters           map[string]ReporterSettings `yaml:"reporters"`
+	All                 AllConfig                   `yaml:"all"`
+	Single              SingleConfig                `yaml:"single"`
+	Composition         CompositionFileConfig       `yaml:"composition"`
+}
+
+// ReporterSettings contains the settings of a single reporter. Only the settings relevant to a reporter are used.
+type ReporterSettings struct {
+	Output   string `yaml:"output"`   // Output: Used by the jsonl reporter
+	URL      string `yaml:"url"`      // URL: Used by the elasticsearch reporter
+	Index    string `yaml:"index"`    // Index: Used by the elasticsearch reporter
+	Username string `yaml:"username"` // Username: Used by the elasticsearch reporter
+	Password string `yaml:"password"` // Password: Used by the elasticsearch reporter
+	APIKey   string `yaml:"api_key"`  // APIKey: Used by the elasticsearch reporter
+
+	AggregateFile string `yaml:"aggregate_file"` // AggregateFile: Used by the junit reporter
+	PerImage      *bool  `yaml:"per_image"`      // PerImage: Used by the junit reporter
+}
+
+// AllConfig contains the settings of the report all command.
+type AllConfig struct {
+	RepositoryInclude []string `yaml:"repository_include"`
+	RepositoryExclude []string `yaml:"repository_exclude"`
+	RepositoryTags    []string `yaml:"repository_tag"`
+}
+
+// SingleConfig contains the settings of the report single command.
+type SingleConfig struct {
+	ImageID     string `yaml:"image_id"`
+	ImageTag    string `yaml:"image_tag"`
+	ImageDigest string `yaml:"image_digest"`
+}
+
+// CompositionFileConfig contains the settings of the report composition command.
+type CompositionFileConfig struct {
+	File        string  `yaml:"file"`
+	Format      string  `yaml:"format"`
+	StripPrefix *string `yaml:"strip_prefix"`
+	StripSuffix *string `yaml:"strip_suffix"`
+}
+
+// LoadConfig opens and parses a configuration file and returns a Config and an error. If no configFile is specified
+// just returns an empty object to simplify downstream logic. We do not log here since the logger is configured using
+// values from this file.
+func LoadConfig(configFile string) (config Config, err error) {
+	if configFile == "" {
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return config, err
+	}
+	err = yaml.UnmarshalStrict(data, &config)
+	return config, err
+}
+
+// ConfigFlagDefaults converts a Config into the flag values it represents. Returns a map of command ("" for top level
+// flags, "report", "report all", "report single", "report composition" or "allowlist check") to a map of flag name to
+// values. Settings that are not present in the Config are omitted.
+func ConfigFlagDefaults(config Config) map[string]map[string][]string {
+	defaults := map[string]map[string][]string{
+		"":                   {},
+		"report":             {},
+		"report all":         {},
+		"report single":      {},
+		"report composition": {},
+		"allowlist check":    {},
+	}
+	setString(defaults[""], "registry-id", config.RegistryID)
+	setString(defaults[""], "base-repo", config.BaseRepo)
+	setString(defaults[""], "region", config.Region)
+	setBool(defaults[""], "latest-tag", config.LatestTag)
+	setString(defaults[""], "latest-tag-filter", config.LatestTagFilter)
+	if len(config.TagInclude) > 0 {
+		defaults[""]["tag-include"] = config.TagInclude
+	}
+	if len(config.TagExclude) > 0 {
+		defaults[""]["tag-exclude"] = config.TagExclude
+	}
+	setString(defaults[""], "latest-strategy", config.LatestStrategy)
+	setString(defaults[""], "latest-strategy-regex", config.LatestRegex)
+	setInt(defaults[""], "max-retries", config.MaxRetries)
+	setBool(defaults[""], "verbose", config.Verbose)
+
+	report := config.Report
+	setString(defaults["report"], "output-dir", report.OutputDir)
+	setString(defaults["report"], "allowlist", report.Allowlist)
+	setString(defaults["allowlist check"], "allowlist", report.Allowlist)
+	setString(defaults["report"], "cutoff", report.Cutoff)
+	if len(report.FailOn) > 0 {
+		defaults["report"]["fail-on"] = report.FailOn
+	}
+	setInt(defaults["report"], "concurrency", report.Concurrency)
+	setInt(defaults["report"], "latest-count", report.LatestCount)
+	setString(defaults["report"], "pushed-within", report.PushedWithin)
+	setBool(defaults["report"], "start-scan", report.StartScan)
+	setString(defaults["report"], "scan-timeout", report.ScanTimeout)
+	setString(defaults["report"], "scan-poll-interval", report.ScanPollInterval)
+	setString(defaults["report"], "scan-max-poll-interval", report.ScanMaxPollInterval)
+
+	if len(report.Reporters) > 0 {
+		// Sort names so the order reporters run in does not depend on map iteration.
+		var names []string
+		for name := range report.Reporters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		defaults["report"]["reporter"] = []string{strings.Join(names, ",")}
+	}
+	junit := report.Reporters["junit"]
+	setString(defaults["report"], "junit-aggregate-file", junit.AggregateFile)
+	setBool(defaults["report"], "junit-per-image", junit.PerImage)
+	jsonl := report.Reporters["jsonl"]
+	setString(defaults["report"], "jsonl-output", jsonl.Output)
+	elasticsearch := report.Reporters["elasticsearch"]
+	setString(defaults["report"], "es-url", elasticsearch.URL)
+	setString(defaults["report"], "es-index", elasticsearch.Index)
+	setString(defaults["report"], "es-username", elasticsearch.Username)
+	setString(defaults["report"], "es-password", elasticsearch.Password)
+	setString(defaults["report"], "es-api-key", elasticsearch.APIKey)
+
+	if len(report.All.RepositoryInclude) > 0 {
+		defaults["report all"]["repository-include"] = report.All.RepositoryInclude
+	}
+	if len(report.All.RepositoryExclude) > 0 {
+		defaults["report all"]["repository-exclude"] = report.All.RepositoryExclude
+	}
+	if len(report.All.RepositoryTags) > 0 {
+		defaults["report all"]["repository-tag"] = report.All.RepositoryTags
+	}
+
+	setString(defaults["report single"], "image-id", report.Single.ImageID)
+	setString(defaults["report single"], "image-tag", report.Single.ImageTag)
+	setString(defaults["report single"], "image-digest", report.Single.ImageDigest)
+
+	setString(defaults["report composition"], "compositionfile", report.Composition.File)
+	setString(defaults["report composition"], "format", report.Composition.Format)
+	if report.Composition.StripPrefix != nil {
+		defaults["report composition"]["strip-prefix"] = []string{*report.Composition.StripPrefix}
+	}
+	if report.Composition.StripSuffix != nil {
+		defaults["report composition"]["strip-suffix"] = []string{*report.Composition.StripSuffix}
+	}
+	return defaults
+}
+
+// setString adds a flag value to a map of flag defaults when it is not empty.
+func setString(defaults map[string][]string, flag string, value string) {
+	if value != "" {
+		defaults[flag] = []string{value}
+	}
+}
+
+// setBool adds a flag value to a map of flag defaults when it is present.
+func setBool(defaults map[string][]string, flag string, value *bool) {
+	if value != nil {
+		defaults[flag] = []string{strconv.FormatBool(*value)}
+	}
+}
+
+// setInt adds a flag value to a map of flag defaults when it is present.
+func setInt(defaults map[string][]string, flag string, value *int) {
+	if value != nil {
+		defaults[flag] = []string{strconv.Itoa(*value)}
+	}
+}
@@ -6,13 +6,15 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/google/logger"
-	"gopkg.in/yaml.v2"
 )
 
 // contains a bunch of helper functions / structs / concepts that we need across packages.
@@ -22,6 +24,26 @@ type ReporterConfig struct {
 	ReportFileName string // ReportFileName: What filename to use when writing out the report file (if applicable), Liable to change when more reporters are added
 	ReporterType   string // ReporterType: What reporter to use
 	ReportBaseDir  string // ReportBaseDir: What directory to use when writing out the report file (if applicable), Liable to change when more reporters are added
+
+	JSONLinesOutput string              // JSONLinesOutput: Where the jsonl reporter writes to, "-" for stdout, a filename for a single file or empty for a file per image in ReportBaseDir
+	Elasticsearch   ElasticsearchConfig // Elasticsearch: Settings used by the elasticsearch reporter
+	JUnit           JUnitConfig         // JUnit: Settings used by the junit reporter
+}
+
+// JUnitConfig is a simple object we use to avoid parameter bloat containing the settings of the junit reporter.
+type JUnitConfig struct {
+	AggregateFile string // AggregateFile: Name of a single file (in ReportBaseDir) containing a testsuite per image, empty to disable
+	PerImage      bool   // PerImage: Whether to write a (timestamped) file per image as well
+}
+
+// ElasticsearchConfig is a simple object we use to avoid parameter bloat containing the settings the elasticsearch reporter
+// needs to index findings. Either Username and Password or APIKey can be used for authentication.
+type ElasticsearchConfig struct {
+	URL      string // URL: Base url of the Elasticsearch cluster, the _bulk endpoint is appended to this
+	Index    string // Index: Name of the index to write to, may contain a date pattern between braces using Go's time layout, e.g. ecr-scans-{2006.01.02}
+	Username string // Username: Username used for basic authentication
+	Password string // Password: Password used for basic authentication
+	APIKey   string // APIKey: Base64 encoded API key (id:api_key) used for API key authentication. Takes precedence over basic authentication
 }
 
 // CompositionConfig is a simple object we use to avoid parameter bloat containing some parameters describing a CompositionFile and operations that need to be performed
@@ -32,28 +54,67 @@ type CompositionConfig struct {
 	BaseRepo            string // BaseRepo is a string that is added as <BaseRepo>/ImageName:ImageTag to avoid having to add shared prefices in CompositionFileName
 	StripPrefix         string // StripPrefix is used to strip shared prefixes (such as "p_,rc_,r_") from the entries in CompositionFile when parsing that in CompositionParser
 	StripSuffix         string // StripSuffix is used to strip shared suffixes (such as "_version") from the entries in CompositionFile when parsing that in CompositionParser
+	Format              string // Format is the format of CompositionFile, one of the CompositionFormat constants
+	Region              string // Region is used to filter ECR image URIs in formats that contain them to images we can query
 }
 
-// NewCompositionConfig returns a CompositionConfig based on compositionFile (filepath to yaml file with composition, see README.MD for format), baserepo, stripPrefix, stripSuffix.
-func NewCompositionConfig(compositionFile *string, baseRepo *string, stripPrefix *string, stripSuffix *string) CompositionConfig {
+// ScanConfig is a simple object we use to avoid parameter bloat when (optionally) starting scans for images that have
+// not been scanned yet and waiting for those scans to complete before results are retrieved.
+type ScanConfig struct {
+	StartScan       bool          // StartScan: Whether to start a scan for images that have no scan results yet
+	Timeout         time.Duration // Timeout: How long to wait for a scan to leave IN_PROGRESS before giving up
+	PollInterval    time.Duration // PollInterval: Initial interval between polls of the scan status, doubled after every poll
+	MaxPollInterval time.Duration // MaxPollInterval: Upper bound for the (backed off) interval between polls
+}
+
+// NewCompositionConfig returns a CompositionConfig based on compositionFile (filepath to yaml file with composition, see README.MD for format), baserepo, stripPrefix, stripSuffix, format and region.
+func NewCompositionConfig(compositionFile *string, baseRepo *string, stripPrefix *string, stripSuffix *string, format *string, region *string) CompositionConfig {
 	return CompositionConfig{
 		CompositionFileName: *compositionFile,
 		BaseRepo:            *baseRepo,
 		StripPrefix:         *stripPrefix,
 		StripSuffix:         *stripSuffix,
+		Format:              *format,
+		Region:              *region,
 	}
 }
 
-// NewImageDefinition takes a registryID (AWS account ID), repositoryName (name of container) and imageTag, returns a
-// ecr.Image object.
-func NewImageDefinition(registryID *string, repositoryName string, imageTag string) (image ecr.Image) {
-	return ecr.Image{
-		ImageId: &ecr.ImageIdentifier{
-			ImageTag: &imageTag,
-		},
+// NewImageDefinition takes a registryID (AWS account ID), repositoryName (name of container) and imageReference (either
+// a tag or a digest in the form of sha256:<hash>), returns a ecr.Image object.
+func NewImageDefinition(registryID *string, repositoryName string, imageReference string) (image ecr.Image) {
+	image = ecr.Image{
+		ImageId:        &ecr.ImageIdentifier{},
 		RegistryId:     registryID,
 		RepositoryName: aws.String(repositoryName),
 	}
+	if IsImageDigest(imageReference) {
+		image.ImageId.ImageDigest = aws.String(imageReference)
+	} else {
+		image.ImageId.ImageTag = aws.String(imageReference)
+	}
+	return image
+}
+
+// IsImageDigest checks if an image reference is a digest (sha256:<hash>) rather than a tag. Tags cannot contain a colon
+// so we only need to check for the algorithm prefix.
+func IsImageDigest(imageReference string) bool {
+	return strings.HasPrefix(imageReference, "sha256:")
+}
+
+// FormatImageReference returns a human readable reference for an ecr.Image in the format of repository:tag@digest,
+// omitting the tag and/or digest when these are not known.
+func FormatImageReference(image *ecr.Image) string {
+	reference := aws.StringValue(image.RepositoryName)
+	if image.ImageId == nil {
+		return reference
+	}
+	if aws.StringValue(image.ImageId.ImageTag) != "" {
+		reference = fmt.Sprintf("%s:%s", reference, *image.ImageId.ImageTag)
+	}
+	if aws.StringValue(image.ImageId.ImageDigest) != "" {
+		reference = fmt.Sprintf("%s@%s", reference, *image.ImageId.ImageDigest)
+	}
+	return reference
 }
 
 // NewCustomReporterConfig Returns a ReporterConfig
@@ -65,12 +126,59 @@ func NewCustomReporterConfig(filename string, basedir string, reporterType strin
 	}
 }
 
-// NewDefaultAwsConfig returns a default config with only region specified. Use profile config for other options.
-func NewDefaultAwsConfig(region *string) aws.Config {
+// NewElasticsearchConfig Returns an ElasticsearchConfig
+func NewElasticsearchConfig(url string, index string, username string, password string, apiKey string) (config ElasticsearchConfig) {
+	return ElasticsearchConfig{
+		URL:      url,
+		Index:    index,
+		Username: username,
+		Password: password,
+		APIKey:   apiKey,
+	}
+}
+
+// NewJUnitConfig Returns a JUnitConfig
+func NewJUnitConfig(aggregateFile string, perImage bool) (config JUnitConfig) {
+	return JUnitConfig{
+		AggregateFile: aggregateFile,
+		PerImage:      perImage,
+	}
+}
+
+// NewScanConfig Returns a ScanConfig
+func NewScanConfig(startScan bool, timeout time.Duration, pollInterval time.Duration, maxPollInterval time.Duration) (config ScanConfig) {
+	return ScanConfig{
+		StartScan:       startScan,
+		Timeout:         timeout,
+		PollInterval:    pollInterval,
+		MaxPollInterval: maxPollInterval,
+	}
+}
 
-	return aws.Config{
+// Validate returns an error when the poll intervals of a ScanConfig are not positive, which would make waiting for a
+// scan poll ECR continuously.
+func (c ScanConfig) Validate() error {
+	if c.PollInterval <= 0 || c.MaxPollInterval <= 0 {
+		return fmt.Errorf("scan poll interval (%v) and max poll interval (%v) have to be positive", c.PollInterval, c.MaxPollInterval)
+	}
+	return nil
+}
+
+// NewDefaultAwsConfig returns a default config with only region and retry behaviour specified. Use profile config for
+// other options. Failed (or throttled) requests are retried up to maxRetries times using the jittered exponential backoff
+// of the aws sdk, which we need when many images are processed concurrently.
+func NewDefaultAwsConfig(region *string, maxRetries int) aws.Config {
+
+	config := aws.Config{
 		Region: region,
 	}
+	return *request.WithRetryer(&config, client.DefaultRetryer{
+		NumMaxRetries:    maxRetries,
+		MinRetryDelay:    client.DefaultRetryerMinRetryDelay,
+		MinThrottleDelay: client.DefaultRetryerMinThrottleDelay,
+		MaxRetryDelay:    30 * time.Second,
+		MaxThrottleDelay: 30 * time.Second,
+	})
 }
 
 // Check is a generic error check function we use for more readable code.
@@ -78,7 +186,7 @@ func NewDefaultAwsConfig(region *string) aws.Config {
 // template string throws a panic.
 func Check(e error, logger *logger.Logger, a ...interface{}) {
 	if e != nil {
-		logger.Error(a)
+		logger.Error(formatMessage(a))
 		panic(e)
 	}
 }
@@ -88,36 +196,21 @@ func Check(e error, logger *logger.Logger, a ...interface{}) {
 // template string we log as a Fatal then Exit 1's.
 func CheckAndExit(e error, logger *logger.Logger, a ...interface{}) {
 	if e != nil {
-		logger.Fatal(a)
+		logger.Fatal(formatMessage(a))
 		os.Exit(1)
 	}
 }
 
-// Composition parser is a a helper function to massage entries in a ZorgDomein flavoured composition file into a usable
-// format. It takes a pointer to a CompositionConfig and returns a list of generic container objects that can be used as
-// input when interacting with the ECR endpoints.
-// Currently only uses tag identifiers.
-// TODO: Abstract further to allow working with hashes.
-// TODO: Make more generic for different use cases
-func CompositionParser(s *CompositionConfig, r *string, l *logger.Logger) ([]ecr.Image, error) {
-
-	zdComposition := make(map[string]string)
-	imageList := make([]ecr.Image, 0)
-
-	yamlFile, err := fileReader(s.CompositionFileName, l)
-	Check(err, l, "Failed to read file %s: %s", s.CompositionFileName, err)
-
-	l.Infof("unmarshalling contents of %s", s.CompositionFileName)
-	err = yaml.Unmarshal(yamlFile, zdComposition)
-	Check(err, l, "Failed to unmarshal %s, %v", yamlFile, err)
-
-	for c, v := range zdComposition {
-		c = underscoreHyphenator(suffixStripper(prefixStripper(c, s.StripPrefix), s.StripSuffix))
-		image := NewImageDefinition(r, strings.Join([]string{s.BaseRepo, c}, "/"), v)
-		imageList = append(imageList, image)
+// formatMessage is a helper function for Check and CheckAndExit that populates the template string (first element of a)
+// with the remaining elements. Falls back to printing all elements when no template string is supplied.
+func formatMessage(a []interface{}) string {
+	if len(a) == 0 {
+		return ""
 	}
-
-	return imageList, err
+	if template, ok := a[0].(string); ok {
+		return fmt.Sprintf(template, a[1:]...)
+	}
+	return fmt.Sprint(a...)
 }
 
 // ExtractPackageAttributes is a helper function used to query attributes in a given ecr.ImageScanFinding. We use this
@@ -142,6 +235,27 @@ func FileNameFormatter(filename string, fileExtension string) string {
 	return path.Base(fmt.Sprintf("%s-%s.%s", filename, timeStamper(), fileExtension))
 }
 
+// ParseDuration parses a duration like time.ParseDuration does, additionally accepting a number of days (30d) or weeks
+// (2w). An empty string is parsed as zero.
+func ParseDuration(duration string) (time.Duration, error) {
+	var unit time.Duration
+	switch {
+	case duration == "":
+		return 0, nil
+	case strings.HasSuffix(duration, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(duration, "w"):
+		unit = 7 * 24 * time.Hour
+	default:
+		return time.ParseDuration(duration)
+	}
+	count, err := strconv.Atoi(duration[:len(duration)-1])
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("invalid duration %s", duration)
+	}
+	return time.Duration(count) * unit, nil
+}
+
 // StringPointerChecker guards against nil pointer issues and returns a message in case pointer is nil to avoid issues
 // with optional fields. TODO: convert message to interface to allow for templatable messages.
 func StringPointerChecker(pointer *string, message string) string {
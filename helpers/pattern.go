@@ -0,0 +1,67 @@
+package helpers
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Contains the glob and regular expression matching used by allowlist entries and container keys.
+
+// regexPrefix marks a pattern as a regular expression rather than a glob or plain string.
+const regexPrefix = "re:"
+
+// compilePattern compiles a pattern into a regular expression. Patterns prefixed with "re:" are regular expressions
+// (matched anywhere unless anchored), patterns containing glob characters (*, ? or [...]) have to match completely and
+// anything else is matched literally, either as a prefix or completely depending on prefixMatch.
+func compilePattern(pattern string, prefixMatch bool) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, regexPrefix) {
+		return regexp.Compile(strings.TrimPrefix(pattern, regexPrefix))
+	}
+	if isGlob(pattern) {
+		return regexp.Compile("^" + globToRegexp(pattern) + "$")
+	}
+	if prefixMatch {
+		return regexp.Compile("^" + regexp.QuoteMeta(pattern))
+	}
+	return regexp.Compile("^" + regexp.QuoteMeta(pattern) + "$")
+}
+
+// isRegexPattern returns true when a pattern is a regular expression.
+func isRegexPattern(pattern string) bool {
+	return strings.HasPrefix(pattern, regexPrefix)
+}
+
+// isGlob returns true when a pattern contains glob characters.
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// globToRegexp converts a glob into (the body of) a regular expression. '*' matches any sequence of characters
+// (including '/'), '?' matches a single character and [...] (or [!...]) matches a character class.
+func globToRegexp(glob string) string {
+	var expression strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			expression.WriteString(".*")
+		case '?':
+			expression.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				// Unterminated class, match the bracket literally.
+				expression.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expression.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expression.String()
+}
@@ -2,110 +2,149 @@ package helpers
 
 import (
 	"errors"
-	"strings"
+	"fmt"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/google/logger"
 )
 
 // Contains functions that handle (meta)data from the ECR api's we use.
 
-// GetLatestTag queries the ecr.Repository for the lastest tag. takes a filter string to filter out particular tags.
-// We use this filtering to not scan 'experimental' or 'snapshot' containers that are only used for development but still get pushed to the
-// Repository. Returns a containerTag string and an error.
-func GetLatestTag(repository *ecr.Repository, filter *string, session *session.Session, l *logger.Logger) (containerTag *string, err error) {
+// describeImagesBatchSize is the maximum number of image identifiers the DescribeImages api accepts in a single call.
+const describeImagesBatchSize = 100
+
+// ErrNoTags is returned (wrapped) by GetLatestTag and GetLatestTags when a repository has no tagged images or none of
+// its tags qualify, as opposed to errors querying ECR.
+var ErrNoTags = errors.New("no qualifying tags")
+
+// GetLatestTag queries the ecr.Repository for the lastest tag according to the strategy of a TagSelection. Its filter
+// string and include/exclude patterns are used to filter out particular tags. We use this filtering to not scan
+// 'experimental' or 'snapshot' containers that are only used for development but still get pushed to the Repository.
+// Every tag of every image is considered, so images with multiple tags are not judged by their first tag only. Returns a
+// containerTag string and an error.
+func GetLatestTag(repository *ecr.Repository, selection TagSelection, svc *ecr.ECR, l *logger.Logger) (containerTag *string, err error) {
+	imageDetails, err := getSelectableImageDetails(repository, selection, svc, l)
+	if err != nil {
+		return nil, err
+	}
+
+	containerTag = selectLatestTag(imageDetails, selection)
+	if containerTag == nil {
+		return nil, fmt.Errorf("%w: no tag of %s qualifies for the %s strategy", ErrNoTags, *repository.RepositoryName, selection.Strategy)
+	}
+	l.Infof("Selected tag %s of %s using the %s strategy", *containerTag, *repository.RepositoryName, selection.Strategy)
+	return containerTag, nil
+}
+
+// GetLatestTags queries the ecr.Repository for the latest tag of each of the Count latest images and/or the images
+// pushed Within a duration of a TagSelection, using the same filtering and strategy as GetLatestTag. Returns the tags
+// ordered from latest to earliest, which is empty (without an error) when no images were pushed within the duration.
+func GetLatestTags(repository *ecr.Repository, selection TagSelection, svc *ecr.ECR, l *logger.Logger) (containerTags []*string, err error) {
+	imageDetails, err := getSelectableImageDetails(repository, selection, svc, l)
+	if err != nil {
+		return nil, err
+	}
+
+	containerTags = selectLatestTags(imageDetails, selection, time.Now())
+	if len(containerTags) == 0 && selectLatestTag(imageDetails, selection) == nil {
+		return nil, fmt.Errorf("%w: no tag of %s qualifies for the %s strategy", ErrNoTags, *repository.RepositoryName, selection.Strategy)
+	}
+	l.Infof("Selected %d tag(s) of %s using the %s strategy", len(containerTags), *repository.RepositoryName, selection.Strategy)
+	return containerTags, nil
+}
+
+// getSelectableImageDetails is a helper function for GetLatestTag and GetLatestTags that retrieves the details of every
+// tagged image in a repository that has at least one tag that is not filtered out by a TagSelection.
+func getSelectableImageDetails(repository *ecr.Repository, selection TagSelection, svc *ecr.ECR, l *logger.Logger) ([]*ecr.ImageDetail, error) {
 
 	// Get all tags/identifiers
-	imageIdentifiers, err := listImageIdentifiers(repository, session, l)
+	imageIdentifiers, err := listImageIdentifiers(repository, svc, l)
 	if err != nil {
 		l.Error("Failed to retrieve list of images")
 		return nil, err
 	}
+	if len(imageIdentifiers) == 0 {
+		return nil, fmt.Errorf("%w: %s has no tagged images", ErrNoTags, *repository.RepositoryName)
+	}
 	// Check if we need to filter the indentifiers and then do so if needed.
-	if *filter != "" {
-		imageIdentifiers, err = filterImageIdentifiers(imageIdentifiers, filter, l)
+	if selection.Filtered() {
+		imageIdentifiers, err = filterImageIdentifiers(imageIdentifiers, selection, l)
 	}
 	if err != nil {
-		l.Errorf("Failed to filter list of images for %s", repository.RepositoryName)
+		l.Errorf("Failed to filter list of images for %s", *repository.RepositoryName)
 		return nil, err
 	}
 	// Use returned and optionally filtered list of imageIdentifiers and query ECR for metadata
-	imagesWithTimestamp, err := getImageDetails(repository, imageIdentifiers, session, l)
+	imageDetails, err := getImageDetails(repository, imageIdentifiers, svc, l)
 	if err != nil {
 		l.Error("Failed to retieve list of image details")
 		return nil, err
 	}
+	return imageDetails, nil
+}
 
-	// define top level variables for logic to determine most recently pushed image
-	var imageAges []time.Duration
-	var minAge time.Duration
-
-	if len(imagesWithTimestamp) > 0 {
-
-		// iterate over list of *ecr.ImageDetail to generate a list of 'ages'
-		for image := range imagesWithTimestamp {
-			imageAges = append(imageAges, time.Since(*imagesWithTimestamp[image].ImagePushedAt))
-		}
-		// handle potential (but very unlikely) nil slice
-		if len(imageAges) == 0 {
-			return nil, errors.New("no imageage could be determined. Check metadata in console")
-		}
-		var index int
-
-		// find index of lowest age (and as such most recently pushed image)
-		for a := range imageAges {
-			if imageAges[a] < minAge {
-				minAge = imageAges[a]
-				index = a
-			}
-
-		}
-		// Return tag for most recently pushed image.
-		return imagesWithTimestamp[index].ImageTags[0], nil //return imagesWithTimestamp[blaat].ImageTags[0], nil
-
-		// handle case where only a single image is present
-	} else if len(imagesWithTimestamp) == 1 {
-		return imagesWithTimestamp[0].ImageTags[0], nil
-		// handle all other cases returning nothing
-	} else {
-		return
+// ResolveImageDigest queries ECR for the details of an ecr.Image and fills in the (immutable) digest of the image so
+// reports record what is actually running. When an image is referenced by digest only, the first tag of that image is
+// filled in as well to keep reports readable.
+// Returns an error if the details of the image could not be retrieved.
+func ResolveImageDigest(image *ecr.Image, svc *ecr.ECR, l *logger.Logger) (err error) {
+	repository := &ecr.Repository{
+		RegistryId:     image.RegistryId,
+		RepositoryName: image.RepositoryName,
+	}
+	imageDetails, err := getImageDetails(repository, []*ecr.ImageIdentifier{image.ImageId}, svc, l)
+	if err != nil {
+		return err
+	}
+	image.ImageId.ImageDigest = imageDetails[0].ImageDigest
+	if aws.StringValue(image.ImageId.ImageTag) == "" && len(imageDetails[0].ImageTags) > 0 {
+		image.ImageId.ImageTag = imageDetails[0].ImageTags[0]
 	}
+	return nil
 }
 
 // filterImageIdentifiers is a helper function for GetLatestTag that we use to filter the returned image identifiers (tags specifically) to omit them from the results.
-func filterImageIdentifiers(unfilteredIdentifiers []*ecr.ImageIdentifier, filterQuery *string, l *logger.Logger) (filteredImageIdentifiers []*ecr.ImageIdentifier, err error) {
+func filterImageIdentifiers(unfilteredIdentifiers []*ecr.ImageIdentifier, selection TagSelection, l *logger.Logger) (filteredImageIdentifiers []*ecr.ImageIdentifier, err error) {
 
 	// iterate over all identifiers
 	for i := range unfilteredIdentifiers {
-		l.Infof("Checking tag  %s versus filter %s \n", *unfilteredIdentifiers[i].ImageTag, *filterQuery)
-		// if filter does not match append to list of returned identifiers
-		if strings.Contains(*unfilteredIdentifiers[i].ImageTag, *filterQuery) == false {
+		// if tag is allowed by the filters append to list of returned identifiers
+		if selection.Allows(*unfilteredIdentifiers[i].ImageTag) {
 			filteredImageIdentifiers = append(filteredImageIdentifiers, unfilteredIdentifiers[i])
 		}
 	}
-	// output how many results are being omited based on what filter query
-	l.Infof("%v tags matched filter %s.\n", len(unfilteredIdentifiers)-len(filteredImageIdentifiers), *filterQuery)
+	// output how many results are being omited by the filters
+	l.Infof("%v tags filtered out.\n", len(unfilteredIdentifiers)-len(filteredImageIdentifiers))
 
-	// handle case where filter would filter out all identifiers
+	// handle case where filters would filter out all identifiers
 	if len(filteredImageIdentifiers) == 0 {
-		return nil, errors.New("All tags match filter. check filter/available tags.")
+		return nil, fmt.Errorf("%w: all tags are filtered out. check filters/available tags", ErrNoTags)
 	}
 	return filteredImageIdentifiers, nil
 }
 
 // getImageDetails queries ECR for details of a given image for it's identifier
-func getImageDetails(repository *ecr.Repository, identifiers []*ecr.ImageIdentifier, session *session.Session, l *logger.Logger) ([]*ecr.ImageDetail, error) {
+func getImageDetails(repository *ecr.Repository, identifiers []*ecr.ImageIdentifier, svc *ecr.ECR, l *logger.Logger) ([]*ecr.ImageDetail, error) {
 	l.Infof("Getting details for tagged images in %s", *repository.RepositoryName)
 
-	describeImagesInput := createDescribeImagesInput(repository, identifiers)
-
-	svc := ecr.New(session)
-
-	describeImagesOutput, err := svc.DescribeImages(describeImagesInput)
+	// DescribeImages only accepts a limited number of identifiers per call so we query them in batches and follow
+	// NextToken for each batch.
+	describeImagesOutput := &ecr.DescribeImagesOutput{}
+	var err error
+	for start := 0; start < len(identifiers) && err == nil; start += describeImagesBatchSize {
+		end := start + describeImagesBatchSize
+		if end > len(identifiers) {
+			end = len(identifiers)
+		}
+		describeImagesInput := createDescribeImagesInput(repository, identifiers[start:end])
+		err = svc.DescribeImagesPages(describeImagesInput, func(page *ecr.DescribeImagesOutput, lastPage bool) bool {
+			describeImagesOutput.ImageDetails = append(describeImagesOutput.ImageDetails, page.ImageDetails...)
+			return true
+		})
+	}
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
@@ -125,6 +164,8 @@ func getImageDetails(repository *ecr.Repository, identifiers []*ecr.ImageIdentif
 			// Message from an error.
 			l.Error(err.Error())
 		}
+		// Never return a partial set of details, callers would pick the latest tag from a truncated list.
+		return nil, err
 	}
 	if describeImagesOutput != nil && describeImagesOutput.ImageDetails != nil && len(describeImagesOutput.ImageDetails) > 0 {
 		return describeImagesOutput.ImageDetails, nil
@@ -134,14 +175,16 @@ func getImageDetails(repository *ecr.Repository, identifiers []*ecr.ImageIdentif
 }
 
 // listImageIdentifiers retreives ImageIdentifiers (tags and or hashes) from a given ECR repository.
-func listImageIdentifiers(repository *ecr.Repository, session *session.Session, l *logger.Logger) (imageIdentifiers []*ecr.ImageIdentifier, err error) {
+func listImageIdentifiers(repository *ecr.Repository, svc *ecr.ECR, l *logger.Logger) (imageIdentifiers []*ecr.ImageIdentifier, err error) {
 	l.Infof("Grabbing list of Tags for Repository %s", *repository.RepositoryName)
 
 	listImagesInput := createListImagesInput(repository)
 
-	svc := ecr.New(session)
-
-	listImageOutput, err := svc.ListImages(listImagesInput)
+	listImageOutput := &ecr.ListImagesOutput{}
+	err = svc.ListImagesPages(listImagesInput, func(page *ecr.ListImagesOutput, lastPage bool) bool {
+		listImageOutput.ImageIds = append(listImageOutput.ImageIds, page.ImageIds...)
+		return true
+	})
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
@@ -164,12 +207,12 @@ func listImageIdentifiers(repository *ecr.Repository, session *session.Session,
 	if len(listImageOutput.ImageIds) > 0 {
 		return listImageOutput.ImageIds, nil
 	} else {
-		l.Warningf("No Tags found for repository %s", repository.RepositoryName)
+		l.Warningf("No Tags found for repository %s", *repository.RepositoryName)
 		return
 	}
 }
 
-func GetEcrRepositories(registryID *string, session *session.Session, l logger.Logger) (repositoryList []*ecr.Repository, err error) {
+func GetEcrRepositories(registryID *string, svc *ecr.ECR, l logger.Logger) (repositoryList []*ecr.Repository, err error) {
 	if registryID != nil {
 		l.Infof("Getting list of ECR repostitories for registry %s", *registryID)
 	} else {
@@ -177,9 +220,11 @@ func GetEcrRepositories(registryID *string, session *session.Session, l logger.L
 	}
 	input, _ := createDescribeRepositoriesInput(registryID) //Use default registry for now
 
-	svc := ecr.New(session)
-
-	result, err := svc.DescribeRepositories(input)
+	result := &ecr.DescribeRepositoriesOutput{}
+	err = svc.DescribeRepositoriesPages(input, func(page *ecr.DescribeRepositoriesOutput, lastPage bool) bool {
+		result.Repositories = append(result.Repositories, page.Repositories...)
+		return true
+	})
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
@@ -202,6 +247,36 @@ func GetEcrRepositories(registryID *string, session *session.Session, l logger.L
 	return getRepositoryList(result)
 }
 
+// GetRepositoryTags queries ECR for the resource tags of a repository. Returns a map of tag key to value and an error.
+func GetRepositoryTags(repository *ecr.Repository, svc *ecr.ECR, l *logger.Logger) (tags map[string]string, err error) {
+	l.Infof("Getting resource tags of repository %s", *repository.RepositoryName)
+	output, err := svc.ListTagsForResource(&ecr.ListTagsForResourceInput{ResourceArn: repository.RepositoryArn})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case ecr.ErrCodeServerException:
+				l.Error(ecr.ErrCodeServerException, aerr.Error())
+			case ecr.ErrCodeInvalidParameterException:
+				l.Error(ecr.ErrCodeInvalidParameterException, aerr.Error())
+			case ecr.ErrCodeRepositoryNotFoundException:
+				l.Error(ecr.ErrCodeRepositoryNotFoundException, aerr.Error())
+			default:
+				l.Error(aerr.Error())
+			}
+		} else {
+			// Print the error, cast err to awserr.Error to get the Code and
+			// Message from an error.
+			l.Error(err.Error())
+		}
+		return nil, err
+	}
+	tags = make(map[string]string)
+	for _, tag := range output.Tags {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags, nil
+}
+
 func getRepositoryList(I *ecr.DescribeRepositoriesOutput) ([]*ecr.Repository, error) {
 	if len(I.Repositories) > 0 {
 		return I.Repositories, nil
@@ -213,7 +288,7 @@ func getRepositoryList(I *ecr.DescribeRepositoriesOutput) ([]*ecr.Repository, er
 
 func createDescribeRepositoriesInput(registryId *string) (input *ecr.DescribeRepositoriesInput, err error) {
 	input = &ecr.DescribeRepositoriesInput{
-		MaxResults:      aws.Int64(1000), //Avoid dealing with paginated results.
+		MaxResults:      aws.Int64(1000), //Largest page size allowed, remaining pages are retrieved by GetEcrRepositories.
 		NextToken:       nil,
 		RepositoryNames: nil,
 	}
@@ -237,7 +312,7 @@ func createDescribeImagesInput(repository *ecr.Repository, identifiers []*ecr.Im
 func createListImagesInput(repository *ecr.Repository) (input *ecr.ListImagesInput) {
 	input = &ecr.ListImagesInput{
 		Filter:         &ecr.ListImagesFilter{TagStatus: aws.String("TAGGED")},
-		MaxResults:     aws.Int64(100),
+		MaxResults:     aws.Int64(1000), //Largest page size allowed, remaining pages are retrieved by listImageIdentifiers.
 		NextToken:      nil,
 		RepositoryName: repository.RepositoryName,
 	}
@@ -246,11 +321,3 @@ func createListImagesInput(repository *ecr.Repository) (input *ecr.ListImagesInp
 	}
 	return input
 }
-
-func createStartImageScanInput(image *ecr.Image) *ecr.StartImageScanInput {
-	return &ecr.StartImageScanInput{
-		ImageId:        image.ImageId,
-		RegistryId:     image.RegistryId,
-		RepositoryName: image.RepositoryName,
-	}
-}
@@ -0,0 +1,78 @@
+package helpers
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Contains the filters that select which repositories of a registry are reported on.
+
+// RepositoryFilter contains the name patterns and ECR resource tags repositories have to match.
+type RepositoryFilter struct {
+	include []*regexp.Regexp // include: Repositories have to match at least one of these (when present)
+	exclude []*regexp.Regexp // exclude: Repositories may not match any of these
+	Tags    []RepositoryTag  // Tags: Resource tags repositories need to have, all of them have to match
+}
+
+// RepositoryTag is a resource tag a repository needs to have. Any value matches when Value is empty.
+type RepositoryTag struct {
+	Key   string
+	Value string
+}
+
+// NewRepositoryFilter Returns a RepositoryFilter. Include and exclude patterns are literal repository names, globs or
+// regular expressions (prefixed with re:) like allowlist container keys, tags are either key=value or just a key.
+// Returns an error for invalid patterns or tags.
+func NewRepositoryFilter(include []string, exclude []string, tags []string) (filter RepositoryFilter, err error) {
+	if filter.include, err = compileRepositoryPatterns(include); err != nil {
+		return filter, err
+	}
+	if filter.exclude, err = compileRepositoryPatterns(exclude); err != nil {
+		return filter, err
+	}
+	for _, tag := range tags {
+		parts := strings.SplitN(tag, "=", 2)
+		if parts[0] == "" {
+			return filter, fmt.Errorf("invalid repository tag %s, expected key=value or key", tag)
+		}
+		repositoryTag := RepositoryTag{Key: parts[0]}
+		if len(parts) == 2 {
+			repositoryTag.Value = parts[1]
+		}
+		filter.Tags = append(filter.Tags, repositoryTag)
+	}
+	return filter, nil
+}
+
+// compileRepositoryPatterns compiles a list of repository patterns.
+func compileRepositoryPatterns(patterns []string) (expressions []*regexp.Regexp, err error) {
+	for _, pattern := range patterns {
+		expression, err := compilePattern(pattern, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid repository pattern %s: %v", pattern, err)
+		}
+		expressions = append(expressions, expression)
+	}
+	return expressions, nil
+}
+
+// Matches returns true when a repository (name without baseRepo) matches at least one of the include patterns (when
+// present) and none of the exclude patterns.
+func (f RepositoryFilter) Matches(repository string) bool {
+	if len(f.include) > 0 && !matchesAny(f.include, repository) {
+		return false
+	}
+	return !matchesAny(f.exclude, repository)
+}
+
+// MatchesTags returns true when the resource tags of a repository contain every RepositoryTag of the filter.
+func (f RepositoryFilter) MatchesTags(tags map[string]string) bool {
+	for _, tag := range f.Tags {
+		value, ok := tags[tag.Key]
+		if !ok || (tag.Value != "" && value != tag.Value) {
+			return false
+		}
+	}
+	return true
+}
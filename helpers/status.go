@@ -0,0 +1,110 @@
+package helpers
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/google/logger"
+)
+
+// Keeps track of the outcome of every image in a run so we can exit with a code CI pipelines can gate on.
+
+// Exit codes used depending on the --fail-on policy. We skip 2 because that is what the go runtime exits with when
+// panicking (which Check does), we count that as a tool error as well.
+const (
+	ExitCodeOK         = 0 // ExitCodeOK: Nothing the --fail-on policy cares about happened
+	ExitCodeError      = 1 // ExitCodeError: The tool failed to retrieve results or write reports for one or more images, regardless of policy
+	ExitCodeFindings   = 3 // ExitCodeFindings: One or more images have findings above the cutoff that are not allowlisted
+	ExitCodeScanFailed = 4 // ExitCodeScanFailed: One or more images have no (completed) scan or their scan failed
+)
+
+// Values accepted by --fail-on.
+const (
+	FailOnFindings    = "findings"
+	FailOnScanFailure = "scan-failure"
+	FailOnError       = "error"
+)
+
+// RunStatus aggregates the outcome of every image in a run. Safe for concurrent use.
+type RunStatus struct {
+	lock                  *sync.Mutex
+	ImagesWithFindings    []string // ImagesWithFindings: Images with findings above the cutoff that are not allowlisted
+	ImagesWithFailedScans []string // ImagesWithFailedScans: Images without a (completed) scan or with a failed scan
+	ImagesWithErrors      []string // ImagesWithErrors: Images for which results could not be retrieved or reports could not be written
+}
+
+// NewRunStatus returns an empty RunStatus.
+func NewRunStatus() *RunStatus {
+	return &RunStatus{
+		lock: &sync.Mutex{},
+	}
+}
+
+// RecordFindings records an image that has findings above the cutoff that are not allowlisted.
+func (s *RunStatus) RecordFindings(image string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ImagesWithFindings = append(s.ImagesWithFindings, image)
+}
+
+// RecordScanFailure records an image without a (completed) scan or with a failed scan.
+func (s *RunStatus) RecordScanFailure(image string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ImagesWithFailedScans = append(s.ImagesWithFailedScans, image)
+}
+
+// RecordError records an image for which results could not be retrieved or reports could not be written.
+func (s *RunStatus) RecordError(image string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ImagesWithErrors = append(s.ImagesWithErrors, image)
+}
+
+// ExitCode returns the exit code for a run based on a list of policies (FailOnFindings, FailOnScanFailure and/or
+// FailOnError). Tool errors always fail a run, like they did before errors were recorded rather than panicking on, so
+// FailOnError only exists to be explicit. Tool errors take precedence over failed scans, which take precedence over
+// findings.
+func (s *RunStatus) ExitCode(failOn []string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.ImagesWithErrors) > 0 {
+		return ExitCodeError
+	}
+	if len(s.ImagesWithFailedScans) > 0 && contains(failOn, FailOnScanFailure) {
+		return ExitCodeScanFailed
+	}
+	if len(s.ImagesWithFindings) > 0 && contains(failOn, FailOnFindings) {
+		return ExitCodeFindings
+	}
+	return ExitCodeOK
+}
+
+// LogSummary logs the images that have findings, failed scans or errors. Images are sorted since they may have been
+// recorded concurrently.
+func (s *RunStatus) LogSummary(l *logger.Logger) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sort.Strings(s.ImagesWithFindings)
+	sort.Strings(s.ImagesWithFailedScans)
+	sort.Strings(s.ImagesWithErrors)
+	if len(s.ImagesWithFindings) > 0 {
+		l.Warningf("%d image(s) with findings above cutoff: %v", len(s.ImagesWithFindings), s.ImagesWithFindings)
+	}
+	if len(s.ImagesWithFailedScans) > 0 {
+		l.Warningf("%d image(s) without a completed scan: %v", len(s.ImagesWithFailedScans), s.ImagesWithFailedScans)
+	}
+	if len(s.ImagesWithErrors) > 0 {
+		l.Errorf("%d image(s) failed to report: %v", len(s.ImagesWithErrors), s.ImagesWithErrors)
+	}
+}
+
+// contains checks if a list of strings contains a queried string.
+func contains(list []string, query string) bool {
+	for i := range list {
+		if list[i] == query {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,405 @@
+package helpers
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// Contains the strategies used to determine which tag of a repository is the latest one.
+
+const (
+	LatestStrategyPushed       = "pushed"        // LatestStrategyPushed: Tag of the most recently pushed image
+	LatestStrategySemver       = "semver"        // LatestStrategySemver: Highest semantic version (optionally prefixed with v)
+	LatestStrategyLexical      = "lexical"       // LatestStrategyLexical: Highest tag (other than latest) in lexical order
+	LatestStrategyRegexCapture = "regex-capture" // LatestStrategyRegexCapture: Highest value captured by a regular expression
+)
+
+// latestAlias is the tag docker uses by default, ignored by the lexical strategy.
+const latestAlias = "latest"
+
+// semanticVersionPattern matches a semantic version (https://semver.org), optionally prefixed with a v.
+var semanticVersionPattern = regexp.MustCompile(`^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?(?:\+[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?$`)
+
+// TagSelection contains the settings GetLatestTag uses to select the latest tag of a repository.
+type TagSelection struct {
+	Filter    string         // Filter: Tags containing this substring are ignored
+	Strategy  string         // Strategy: One of the LatestStrategy constants
+	Pattern   *regexp.Regexp // Pattern: Regular expression with capture group(s) used by the regex-capture strategy
+	Count     int            // Count: Number of latest images GetLatestTags selects, all when zero
+	Within    time.Duration  // Within: Only images pushed within this duration are selected by GetLatestTags, when set
+	filters   tagFilters     // filters: Include and exclude patterns, replaced by those of a matching override
+	overrides []tagOverride  // overrides: Tag filters of specific repositories, the first matching override is used
+}
+
+// tagFilters are the compiled include and exclude patterns of a TagSelection or TagOverride.
+type tagFilters struct {
+	include []*regexp.Regexp // include: Tags have to match at least one of these (when present)
+	exclude []*regexp.Regexp // exclude: Tags may not match any of these
+}
+
+// tagOverride is a compiled TagOverride.
+type tagOverride struct {
+	repository *regexp.Regexp
+	filters    tagFilters
+}
+
+// NewTagSelection Returns a TagSelection. Returns an error for unknown strategies, invalid include, exclude or
+// repository patterns, or when the regex-capture strategy is used without a valid regular expression containing at
+// least one capture group.
+func NewTagSelection(filter string, include []string, exclude []string, strategy string, strategyRegex string, overrides []TagOverride) (selection TagSelection, err error) {
+	selection = TagSelection{
+		Filter:   filter,
+		Strategy: strategy,
+	}
+	if selection.filters, err = compileTagFilters(include, exclude); err != nil {
+		return selection, err
+	}
+	for _, override := range overrides {
+		repository, err := compilePattern(override.Repository, false)
+		if err != nil {
+			return selection, fmt.Errorf("invalid repository %s: %v", override.Repository, err)
+		}
+		filters, err := compileTagFilters(override.TagInclude, override.TagExclude)
+		if err != nil {
+			return selection, fmt.Errorf("invalid tag filter for repository %s: %v", override.Repository, err)
+		}
+		selection.overrides = append(selection.overrides, tagOverride{repository: repository, filters: filters})
+	}
+	switch strategy {
+	case LatestStrategyPushed, LatestStrategySemver, LatestStrategyLexical:
+	case LatestStrategyRegexCapture:
+		if strategyRegex == "" {
+			return selection, fmt.Errorf("the %s strategy requires a regular expression", strategy)
+		}
+		selection.Pattern, err = regexp.Compile(strategyRegex)
+		if err != nil {
+			return selection, err
+		}
+		if selection.Pattern.NumSubexp() == 0 {
+			return selection, fmt.Errorf("regular expression %s has no capture group", strategyRegex)
+		}
+	default:
+		return selection, fmt.Errorf("unknown latest tag strategy %s", strategy)
+	}
+	return selection, nil
+}
+
+// compileTagFilters compiles lists of include and exclude regular expressions.
+func compileTagFilters(include []string, exclude []string) (filters tagFilters, err error) {
+	if filters.include, err = compileTagPatterns(include); err != nil {
+		return filters, err
+	}
+	filters.exclude, err = compileTagPatterns(exclude)
+	return filters, err
+}
+
+// compileTagPatterns compiles a list of regular expressions.
+func compileTagPatterns(patterns []string) (expressions []*regexp.Regexp, err error) {
+	for _, pattern := range patterns {
+		expression, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag pattern %s: %v", pattern, err)
+		}
+		expressions = append(expressions, expression)
+	}
+	return expressions, nil
+}
+
+// ForRepository returns the TagSelection used for a repository (name without baseRepo). The include and exclude
+// patterns of the first override matching the repository replace those of the TagSelection.
+func (s TagSelection) ForRepository(repository string) TagSelection {
+	for _, override := range s.overrides {
+		if override.repository.MatchString(repository) {
+			s.filters = override.filters
+			break
+		}
+	}
+	return s
+}
+
+// History returns true when a number of latest images (Count) or images pushed within a duration (Within) are selected
+// rather than only the latest one.
+func (s TagSelection) History() bool {
+	return s.Count > 0 || s.Within > 0
+}
+
+// Filtered returns true when the TagSelection excludes any tags.
+func (s TagSelection) Filtered() bool {
+	return s.Filter != "" || len(s.filters.include) > 0 || len(s.filters.exclude) > 0
+}
+
+// Allows returns true when a tag does not contain the filter, matches at least one of the include patterns (when
+// present) and none of the exclude patterns, applied in that order.
+func (s TagSelection) Allows(tag string) bool {
+	if s.Filter != "" && strings.Contains(tag, s.Filter) {
+		return false
+	}
+	if len(s.filters.include) > 0 && !matchesAny(s.filters.include, tag) {
+		return false
+	}
+	return !matchesAny(s.filters.exclude, tag)
+}
+
+// matchesAny returns true when a string (tag or repository) matches any of the regular expressions.
+func matchesAny(expressions []*regexp.Regexp, value string) bool {
+	for _, expression := range expressions {
+		if expression.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// tagCandidate is a tag (of an image) that qualifies for the strategy of a TagSelection.
+type tagCandidate struct {
+	tag      string
+	pushedAt time.Time
+	version  semanticVersion // version: Used by the semver strategy
+	captures []string        // captures: Used by the regex-capture strategy
+}
+
+// semanticVersion is a parsed semantic version. Build metadata is omitted as it does not affect precedence.
+type semanticVersion struct {
+	major, minor, patch uint64
+	preRelease          []string
+}
+
+// selectLatestTag returns the latest tag of a list of images according to the strategy of a TagSelection. Returns nil
+// when no tag qualifies.
+func selectLatestTag(images []*ecr.ImageDetail, selection TagSelection) *string {
+	candidates := latestCandidates(images, selection)
+	if len(candidates) == 0 {
+		return nil
+	}
+	return aws.String(candidates[0].tag)
+}
+
+// selectLatestTags returns the latest tag of the Count latest images (pushed after the Within duration before now, when
+// set) according to the strategy of a TagSelection, ordered from latest to earliest.
+func selectLatestTags(images []*ecr.ImageDetail, selection TagSelection, now time.Time) (tags []*string) {
+	for _, candidate := range latestCandidates(images, selection) {
+		if selection.Count > 0 && len(tags) == selection.Count {
+			break
+		}
+		if selection.Within > 0 && candidate.pushedAt.Before(now.Add(-selection.Within)) {
+			continue
+		}
+		tags = append(tags, aws.String(candidate.tag))
+	}
+	return tags
+}
+
+// latestCandidates returns the latest tag of every image according to the strategy of a TagSelection, ordered from
+// latest to earliest. Every tag of every image is considered, tags the strategy can not order (e.g. tags that are not a
+// semantic version) are ignored and so are images without any qualifying tag. Ties, like an old version that was pushed
+// again, go to the most recently pushed image. Images are only considered once, even when described once per tag.
+func latestCandidates(images []*ecr.ImageDetail, selection TagSelection) (candidates []tagCandidate) {
+	seen := make(map[string]bool)
+	for _, image := range images {
+		if digest := aws.StringValue(image.ImageDigest); digest != "" {
+			if seen[digest] {
+				continue
+			}
+			seen[digest] = true
+		}
+		var latest *tagCandidate
+		for _, tag := range aws.StringValueSlice(image.ImageTags) {
+			if !selection.Allows(tag) {
+				continue
+			}
+			candidate, ok := selection.newCandidate(tag, aws.TimeValue(image.ImagePushedAt))
+			if ok && (latest == nil || selection.compare(candidate, *latest) > 0) {
+				latest = &candidate
+			}
+		}
+		if latest != nil {
+			candidates = append(candidates, *latest)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return selection.compare(candidates[i], candidates[j]) > 0
+	})
+	return candidates
+}
+
+// newCandidate parses a tag for the strategy of a TagSelection. Returns false when the tag does not qualify.
+func (s TagSelection) newCandidate(tag string, pushedAt time.Time) (candidate tagCandidate, ok bool) {
+	candidate = tagCandidate{tag: tag, pushedAt: pushedAt}
+	switch s.Strategy {
+	case LatestStrategySemver:
+		candidate.version, ok = parseSemanticVersion(tag)
+	case LatestStrategyRegexCapture:
+		match := s.Pattern.FindStringSubmatch(tag)
+		if match == nil {
+			return candidate, false
+		}
+		candidate.captures, ok = match[1:], true
+	case LatestStrategyLexical:
+		// latest is a moving alias rather than a version, and would sort after most version schemes.
+		ok = tag != latestAlias
+	default:
+		ok = true
+	}
+	return candidate, ok
+}
+
+// compare returns a positive number when candidate a is later than b, a negative number when it is earlier and 0
+// when they are equal.
+func (s TagSelection) compare(a tagCandidate, b tagCandidate) (c int) {
+	switch s.Strategy {
+	case LatestStrategySemver:
+		c = compareSemanticVersions(a.version, b.version)
+	case LatestStrategyLexical:
+		c = strings.Compare(a.tag, b.tag)
+	case LatestStrategyRegexCapture:
+		for i := 0; i < len(a.captures) && c == 0; i++ {
+			c = compareNatural(a.captures[i], b.captures[i])
+		}
+	}
+	if c == 0 {
+		// The pushed strategy (and ties for all others) are decided by push time.
+		switch {
+		case a.pushedAt.After(b.pushedAt):
+			c = 1
+		case a.pushedAt.Before(b.pushedAt):
+			c = -1
+		}
+	}
+	return c
+}
+
+// parseSemanticVersion parses a tag as a semantic version. Returns false when the tag is not a semantic version.
+func parseSemanticVersion(tag string) (version semanticVersion, ok bool) {
+	match := semanticVersionPattern.FindStringSubmatch(tag)
+	if match == nil {
+		return version, false
+	}
+	var err error
+	if version.major, err = strconv.ParseUint(match[1], 10, 64); err != nil {
+		return version, false
+	}
+	if version.minor, err = strconv.ParseUint(match[2], 10, 64); err != nil {
+		return version, false
+	}
+	if version.patch, err = strconv.ParseUint(match[3], 10, 64); err != nil {
+		return version, false
+	}
+	if match[4] != "" {
+		version.preRelease = strings.Split(match[4], ".")
+	}
+	return version, true
+}
+
+// compareSemanticVersions compares two semantic versions following the precedence rules of the specification: a
+// pre-release has a lower precedence than the release itself and its identifiers are compared one by one.
+func compareSemanticVersions(a semanticVersion, b semanticVersion) int {
+	if c := compareUint(a.major, b.major); c != 0 {
+		return c
+	}
+	if c := compareUint(a.minor, b.minor); c != 0 {
+		return c
+	}
+	if c := compareUint(a.patch, b.patch); c != 0 {
+		return c
+	}
+	switch {
+	case len(a.preRelease) == 0 && len(b.preRelease) == 0:
+		return 0
+	case len(a.preRelease) == 0:
+		return 1
+	case len(b.preRelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(a.preRelease) && i < len(b.preRelease); i++ {
+		if c := comparePreReleaseIdentifiers(a.preRelease[i], b.preRelease[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a.preRelease) - len(b.preRelease)
+}
+
+// comparePreReleaseIdentifiers compares numeric identifiers numerically and others lexically. Numeric identifiers
+// have a lower precedence than alphanumeric ones.
+func comparePreReleaseIdentifiers(a string, b string) int {
+	aNumeric, bNumeric := isNumeric(a), isNumeric(b)
+	switch {
+	case aNumeric && bNumeric:
+		return compareNumeric(a, b)
+	case aNumeric:
+		return -1
+	case bNumeric:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// compareNatural compares strings in natural order: runs of digits are compared numerically and everything else
+// lexically, so date stamps and build numbers of different lengths are ordered as expected.
+func compareNatural(a string, b string) int {
+	for a != "" && b != "" {
+		aRun, bRun := leadingRun(a), leadingRun(b)
+		var c int
+		if isNumeric(aRun) && isNumeric(bRun) {
+			c = compareNumeric(aRun, bRun)
+		} else {
+			c = strings.Compare(aRun, bRun)
+		}
+		if c != 0 {
+			return c
+		}
+		a, b = a[len(aRun):], b[len(bRun):]
+	}
+	return strings.Compare(a, b)
+}
+
+// leadingRun returns the leading run of digits or non-digits of a (non empty) string.
+func leadingRun(s string) string {
+	digit := isDigit(s[0])
+	i := 1
+	for i < len(s) && isDigit(s[i]) == digit {
+		i++
+	}
+	return s[:i]
+}
+
+// compareNumeric compares two strings of digits of arbitrary length numerically.
+func compareNumeric(a string, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+// compareUint compares two unsigned integers.
+func compareUint(a uint64, b uint64) int {
+	switch {
+	case a > b:
+		return 1
+	case a < b:
+		return -1
+	}
+	return 0
+}
+
+// isNumeric returns true when a (non empty) string only contains digits.
+func isNumeric(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// isDigit returns true for the ASCII digits.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,317 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// testNow is the time images in these tests are pushed relative to.
+var testNow = time.Date(2020, 1, 8, 10, 4, 0, 0, time.UTC)
+
+// testImage returns an ecr.ImageDetail with a digest, tags and a push time of age hours before testNow.
+func testImage(digest string, age int, tags ...string) *ecr.ImageDetail {
+	return &ecr.ImageDetail{
+		ImageDigest:   aws.String(digest),
+		ImagePushedAt: aws.Time(testNow.Add(-time.Duration(age) * time.Hour)),
+		ImageTags:     aws.StringSlice(tags),
+	}
+}
+
+// sign reduces the result of a comparison to -1, 0 or 1.
+func sign(c int) int {
+	switch {
+	case c > 0:
+		return 1
+	case c < 0:
+		return -1
+	}
+	return 0
+}
+
+func TestParseSemanticVersion(t *testing.T) {
+	tests := []struct {
+		tag   string
+		valid bool
+	}{
+		{"1.2.3", true},
+		{"v1.2.3", true},
+		{"0.0.0", true},
+		{"1.2.3-rc.1", true},
+		{"1.2.3-alpha-1.beta", true},
+		{"1.2.3+build.5", true},
+		{"1.2.3-rc.1+build.5", true},
+		{"1.2", false},
+		{"1.2.3.4", false},
+		{"01.2.3", false},
+		{"1.2.3-", false},
+		{"V1.2.3", false},
+		{"latest", false},
+		{"release-1.2.3", false},
+		{"99999999999999999999.0.0", false},
+	}
+	for _, test := range tests {
+		if _, valid := parseSemanticVersion(test.tag); valid != test.valid {
+			t.Errorf("parseSemanticVersion(%q) valid = %v, expected %v", test.tag, valid, test.valid)
+		}
+	}
+}
+
+func TestCompareSemanticVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.10.0", "1.9.0", 1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.2.10", "1.2.9", 1},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2.3+build.1", "1.2.3+build.2", 0},
+		// Pre-release precedence as listed in the specification.
+		{"1.0.0", "1.0.0-rc.1", 1},
+		{"1.0.0-rc.1", "1.0.0-beta.11", 1},
+		{"1.0.0-beta.11", "1.0.0-beta.2", 1},
+		{"1.0.0-beta.2", "1.0.0-beta", 1},
+		{"1.0.0-beta", "1.0.0-alpha.beta", 1},
+		{"1.0.0-alpha.beta", "1.0.0-alpha.1", 1},
+		{"1.0.0-alpha.1", "1.0.0-alpha", 1},
+		{"1.0.1-alpha", "1.0.0", 1},
+	}
+	for _, test := range tests {
+		a, aValid := parseSemanticVersion(test.a)
+		b, bValid := parseSemanticVersion(test.b)
+		if !aValid || !bValid {
+			t.Fatalf("%q or %q is not a valid semantic version", test.a, test.b)
+		}
+		if c := sign(compareSemanticVersions(a, b)); c != test.expected {
+			t.Errorf("compareSemanticVersions(%q, %q) = %d, expected %d", test.a, test.b, c, test.expected)
+		}
+		if c := sign(compareSemanticVersions(b, a)); c != -test.expected {
+			t.Errorf("compareSemanticVersions(%q, %q) = %d, expected %d", test.b, test.a, c, -test.expected)
+		}
+	}
+}
+
+func TestCompareNatural(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"10", "9", 1},
+		{"a10", "a9", 1},
+		{"build-10", "build-9", 1},
+		{"20200108_1004", "20191231_2359", 1},
+		{"20200108_1004", "20200108_999", 1},
+		{"007", "7", 0},
+		{"1.10", "1.9", 1},
+		{"abd", "abc", 1},
+		{"1a", "1", 1},
+		{"a", "", 1},
+		{"", "", 0},
+		{"12345678901234567890123", "12345678901234567890122", 1},
+	}
+	for _, test := range tests {
+		if c := sign(compareNatural(test.a, test.b)); c != test.expected {
+			t.Errorf("compareNatural(%q, %q) = %d, expected %d", test.a, test.b, c, test.expected)
+		}
+		if c := sign(compareNatural(test.b, test.a)); c != -test.expected {
+			t.Errorf("compareNatural(%q, %q) = %d, expected %d", test.b, test.a, c, -test.expected)
+		}
+	}
+}
+
+func TestSelectLatestTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		regex    string
+		include  []string
+		exclude  []string
+		images   []*ecr.ImageDetail
+		expected string
+	}{
+		{
+			name:     "pushed picks the most recently pushed image",
+			strategy: LatestStrategyPushed,
+			images:   []*ecr.ImageDetail{testImage("a", 3, "1.0.0"), testImage("b", 1, "0.9.0"), testImage("c", 2, "1.1.0")},
+			expected: "0.9.0",
+		},
+		{
+			name:     "semver ignores re-pushes of old versions",
+			strategy: LatestStrategySemver,
+			images:   []*ecr.ImageDetail{testImage("a", 10, "1.10.0"), testImage("b", 20, "1.9.0"), testImage("c", 1, "1.2.0")},
+			expected: "1.10.0",
+		},
+		{
+			name:     "semver considers every tag of an image",
+			strategy: LatestStrategySemver,
+			images:   []*ecr.ImageDetail{testImage("a", 1, "latest", "snapshot", "2.0.0"), testImage("b", 2, "1.5.0")},
+			expected: "2.0.0",
+		},
+		{
+			name:     "semver prefers a release over its pre-releases",
+			strategy: LatestStrategySemver,
+			images:   []*ecr.ImageDetail{testImage("a", 5, "1.0.0"), testImage("b", 1, "1.0.0-rc.2"), testImage("c", 2, "1.0.0-rc.10")},
+			expected: "1.0.0",
+		},
+		{
+			name:     "semver orders pre-releases numerically",
+			strategy: LatestStrategySemver,
+			images:   []*ecr.ImageDetail{testImage("a", 1, "1.0.0-rc.2"), testImage("b", 2, "1.0.0-rc.10")},
+			expected: "1.0.0-rc.10",
+		},
+		{
+			name:     "ties go to the most recently pushed image",
+			strategy: LatestStrategySemver,
+			images:   []*ecr.ImageDetail{testImage("a", 5, "1.2.3"), testImage("b", 1, "v1.2.3"), testImage("c", 3, "1.2.3+build.7")},
+			expected: "v1.2.3",
+		},
+		{
+			name:     "lexical ignores the latest tag",
+			strategy: LatestStrategyLexical,
+			images:   []*ecr.ImageDetail{testImage("a", 1, "latest", "20200108_1004"), testImage("b", 2, "20191231_2359")},
+			expected: "20200108_1004",
+		},
+		{
+			name:     "lexical only has latest",
+			strategy: LatestStrategyLexical,
+			images:   []*ecr.ImageDetail{testImage("a", 1, "latest")},
+		},
+		{
+			name:     "regex-capture compares digit runs numerically",
+			strategy: LatestStrategyRegexCapture,
+			regex:    `^build-(\d+)$`,
+			images:   []*ecr.ImageDetail{testImage("a", 1, "build-9"), testImage("b", 2, "build-10"), testImage("c", 0, "latest")},
+			expected: "build-10",
+		},
+		{
+			name:     "regex-capture compares capture groups in order",
+			strategy: LatestStrategyRegexCapture,
+			regex:    `^(\d{8})_(\d+)$`,
+			images:   []*ecr.ImageDetail{testImage("a", 1, "20200108_999"), testImage("b", 2, "20200108_1004"), testImage("c", 0, "20191231_2359")},
+			expected: "20200108_1004",
+		},
+		{
+			name:     "include and exclude patterns apply before the strategy",
+			strategy: LatestStrategySemver,
+			include:  []string{`^v`},
+			exclude:  []string{`-rc`},
+			images:   []*ecr.ImageDetail{testImage("a", 1, "v2.0.0-rc.1"), testImage("b", 2, "v1.5.0"), testImage("c", 3, "1.9.0")},
+			expected: "v1.5.0",
+		},
+		{
+			name:     "semver without versions",
+			strategy: LatestStrategySemver,
+			images:   []*ecr.ImageDetail{testImage("a", 1, "latest", "master")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selection, err := NewTagSelection("", test.include, test.exclude, test.strategy, test.regex, nil)
+			if err != nil {
+				t.Fatalf("NewTagSelection returned an error: %v", err)
+			}
+			tag := selectLatestTag(test.images, selection)
+			if test.expected == "" {
+				if tag != nil {
+					t.Errorf("expected no tag, got %s", *tag)
+				}
+				return
+			}
+			if aws.StringValue(tag) != test.expected {
+				t.Errorf("expected %s, got %s", test.expected, aws.StringValue(tag))
+			}
+		})
+	}
+}
+
+func TestSelectLatestTags(t *testing.T) {
+	images := []*ecr.ImageDetail{
+		testImage("a", 50*24, "1.0.0"),
+		testImage("b", 40*24, "1.1.0", "stable"),
+		// The same image described once per tag is only selected once.
+		testImage("b", 40*24, "1.1.0", "stable"),
+		testImage("c", 1*24, "1.0.1"),
+		testImage("d", 10*24, "2.0.0"),
+		testImage("e", 2*24, "nightly"),
+	}
+	tests := []struct {
+		name     string
+		count    int
+		within   time.Duration
+		expected []string
+	}{
+		{name: "count", count: 2, expected: []string{"2.0.0", "1.1.0"}},
+		{name: "all", expected: []string{"2.0.0", "1.1.0", "1.0.1", "1.0.0"}},
+		{name: "within", within: 30 * 24 * time.Hour, expected: []string{"2.0.0", "1.0.1"}},
+		{name: "count within", count: 1, within: 5 * 24 * time.Hour, expected: []string{"1.0.1"}},
+		{name: "nothing within", within: time.Hour},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selection, err := NewTagSelection("", nil, nil, LatestStrategySemver, "", nil)
+			if err != nil {
+				t.Fatalf("NewTagSelection returned an error: %v", err)
+			}
+			selection.Count, selection.Within = test.count, test.within
+			tags := aws.StringValueSlice(selectLatestTags(images, selection, testNow))
+			if len(tags) != len(test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, tags)
+			}
+			for i := range tags {
+				if tags[i] != test.expected[i] {
+					t.Errorf("expected %v, got %v", test.expected, tags)
+				}
+			}
+		})
+	}
+}
+
+func TestTagSelectionForRepository(t *testing.T) {
+	selection, err := NewTagSelection("snapshot", []string{`^release-`}, []string{`-rc`}, LatestStrategyLexical, "", []TagOverride{
+		{Repository: "payments/*", TagInclude: []string{`^\d+$`}},
+	})
+	if err != nil {
+		t.Fatalf("NewTagSelection returned an error: %v", err)
+	}
+	tests := []struct {
+		repository string
+		tag        string
+		allowed    bool
+	}{
+		{"jenkins", "release-1", true},
+		{"jenkins", "release-1-rc2", false},
+		{"jenkins", "release-snapshot", false},
+		{"jenkins", "123", false},
+		{"payments/api", "123", true},
+		{"payments/api", "release-1", false},
+		{"payments/api", "123-snapshot", false},
+	}
+	for _, test := range tests {
+		if allowed := selection.ForRepository(test.repository).Allows(test.tag); allowed != test.allowed {
+			t.Errorf("%s allows %s = %v, expected %v", test.repository, test.tag, allowed, test.allowed)
+		}
+	}
+}
+
+func TestNewTagSelectionErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		include  []string
+		strategy string
+		regex    string
+	}{
+		{name: "unknown strategy", strategy: "newest"},
+		{name: "regex-capture without regex", strategy: LatestStrategyRegexCapture},
+		{name: "regex-capture without capture group", strategy: LatestStrategyRegexCapture, regex: `^build-\d+$`},
+		{name: "invalid regex", strategy: LatestStrategyRegexCapture, regex: `(`},
+		{name: "invalid include", strategy: LatestStrategyPushed, include: []string{`*-rc`}},
+	}
+	for _, test := range tests {
+		if _, err := NewTagSelection("", test.include, nil, test.strategy, test.regex, nil); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
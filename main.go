@@ -1,9 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -17,153 +19,515 @@ import (
 )
 
 var (
-	verbose = kingpin.Flag("verbose", "log actions to stdout").Default("true").Bool()
+	configFile = kingpin.Flag("config", "YAML configuration file. Flags and environment variables override values in this file.").Envar("ESU_CONFIG").Default("").String()
+	verbose    = kingpin.Flag("verbose", "log actions to stdout").Default("true").Bool()
 	//Generic settings used for setting up client
 	registryId      = kingpin.Flag("registry-id", "Aws ECR registry id. Uses default when omitted.").Default("").String()
 	baseRepo        = kingpin.Flag("base-repo", "Used when supplying image names with a common prefix").Default("").String()
 	region          = kingpin.Flag("region", "AWS region").Default("eu-west-1").String()
 	latestTag       = kingpin.Flag("latest-tag", "Get result for most recent tagged image for specified repo. Ignores version of supplied composition if present.").Default("false").Bool()
 	latestTagFilter = kingpin.Flag("latest-tag-filter", "Ignores tags containing this substring.").Default("").String()
+	tagInclude      = kingpin.Flag("tag-include", "Only consider tags matching this regular expression when determining the latest tag. Repeatable, tags have to match at least one.").Strings()
+	tagExclude      = kingpin.Flag("tag-exclude", "Ignore tags matching this regular expression when determining the latest tag. Repeatable, applied after --tag-include.").Strings()
+	latestStrategy  = kingpin.Flag("latest-strategy", "How the latest tag is determined: the tag of the most recently pushed image (pushed), the highest semantic version (semver), the highest tag other than latest in lexical order (lexical) or the highest value captured by --latest-strategy-regex (regex-capture).").Default(helpers.LatestStrategyPushed).Enum(helpers.LatestStrategyPushed, helpers.LatestStrategySemver, helpers.LatestStrategyLexical, helpers.LatestStrategyRegexCapture)
+	latestRegex     = kingpin.Flag("latest-strategy-regex", "Regular expression used by the regex-capture strategy. Tags are ordered by its capture group(s), digits numerically. Tags that do not match are ignored.").Default("").String()
+	maxRetries      = kingpin.Flag("max-retries", "Maximum number of retries (with jittered backoff) for failed or throttled AWS api calls.").Default("10").Int()
 
 	reportCommand        = kingpin.Command("report", "Creates a report containing scan results from ECR's container scans")
 	reportDir            = reportCommand.Flag("output-dir", "Directory to write reports to").Default("reports").String()
 	reportAllowlistFile  = reportCommand.Flag("allowlist", "Allowlist file containing package substrings to ignore per image and/or globally").Default("").String()
 	reportSeverityCutoff = reportCommand.Flag("cutoff", "Severity to count as failures").Default("MEDIUM").String()
-	reportReporters      = reportCommand.Flag("reporter", "Reporter(s) to use").Default("junit").String()
+	reportFailOn         = reportCommand.Flag("fail-on", "Exit with a non-zero code when images have findings above cutoff (findings, exit code 3), no completed scan (scan-failure, exit code 4) or when reporting fails (error, exit code 1, always enabled). Repeatable.").Enums(helpers.FailOnFindings, helpers.FailOnScanFailure, helpers.FailOnError)
+	reportReporters      = reportCommand.Flag("reporter", "Comma separated list of reporter(s) to use").Default("junit").String()
+	reportConcurrency    = reportCommand.Flag("concurrency", "Number of images to retrieve results for in parallel").Default("1").Int()
+	reportLatestCount    = reportCommand.Flag("latest-count", "Report on the N latest images of a repository instead of only the latest tag (report all and single). 0 to disable").Default("0").Int()
+	reportPushedWithin   = reportCommand.Flag("pushed-within", "Report on every image of a repository pushed within this duration (e.g. 30d, 2w or 12h) instead of only the latest tag (report all and single). At most --latest-count images when both are set").Default("").String()
 
-	reportAllCommand = reportCommand.Command("all", "Iterate over all repositories in a given registry. (Finds latest tagged container and returns reports.)")
+	reportJUnitAggregateFile = reportCommand.Flag("junit-aggregate-file", "Name of a single file (in output-dir) the junit reporter writes a testsuite per image to. Empty to disable").Default("").String()
+	reportJUnitPerImage      = reportCommand.Flag("junit-per-image", "Whether the junit reporter writes a file per image. Use --no-junit-per-image to only write the aggregate file").Default("true").Bool()
 
-	reportSingleCommand       = reportCommand.Command("single", "Iterate over a single repository")
-	reportSingleContainerName = reportSingleCommand.Flag("image-id", "Container name to fetch scan results for").Default("").String()
-	reportSingleContainerTag  = reportSingleCommand.Flag("image-tag", "Container tag to fetch scan results for").Default("").String()
+	reportJSONLinesOutput = reportCommand.Flag("jsonl-output", "Where the jsonl reporter writes to. '-' for stdout, a filename for a single file or empty for a file per image in output-dir").Default("").String()
+
+	reportEsURL      = reportCommand.Flag("es-url", "Elasticsearch url used by the elasticsearch reporter").Envar("ESU_ES_URL").Default("http://localhost:9200").String()
+	reportEsIndex    = reportCommand.Flag("es-index", "Elasticsearch index used by the elasticsearch reporter. A date pattern between braces (Go time layout) is replaced with the scan date.").Default("ecr-scan-results-{2006.01.02}").String()
+	reportEsUsername = reportCommand.Flag("es-username", "Username for basic authentication against Elasticsearch").Envar("ESU_ES_USERNAME").Default("").String()
+	reportEsPassword = reportCommand.Flag("es-password", "Password for basic authentication against Elasticsearch").Envar("ESU_ES_PASSWORD").Default("").String()
+	reportEsAPIKey   = reportCommand.Flag("es-api-key", "Base64 encoded API key for Elasticsearch. Takes precedence over basic authentication").Envar("ESU_ES_API_KEY").Default("").String()
+
+	reportStartScan           = reportCommand.Flag("start-scan", "Start a scan for images that have not been scanned yet and wait for scans in progress to complete.").Default("false").Bool()
+	reportScanTimeout         = reportCommand.Flag("scan-timeout", "Maximum time to wait for a scan to complete.").Default("10m").Duration()
+	reportScanPollInterval    = reportCommand.Flag("scan-poll-interval", "Initial interval between polls of the scan status. Doubled after every poll.").Default("5s").Duration()
+	reportScanMaxPollInterval = reportCommand.Flag("scan-max-poll-interval", "Maximum interval between polls of the scan status.").Default("1m").Duration()
+
+	reportAllCommand           = reportCommand.Command("all", "Iterate over all repositories in a given registry. (Finds latest tagged container and returns reports.)")
+	reportAllRepositoryInclude = reportAllCommand.Flag("repository-include", "Only report on repositories (name without base-repo) matching this name, glob or regular expression (prefixed with re:). Repeatable, repositories have to match at least one.").Strings()
+	reportAllRepositoryExclude = reportAllCommand.Flag("repository-exclude", "Skip repositories (name without base-repo) matching this name, glob or regular expression (prefixed with re:). Repeatable.").Strings()
+	reportAllRepositoryTags    = reportAllCommand.Flag("repository-tag", "Only report on repositories with this ECR resource tag (key=value, or key for any value). Repeatable, repositories need to have all of them.").Strings()
+
+	reportSingleCommand         = reportCommand.Command("single", "Iterate over a single repository")
+	reportSingleContainerName   = reportSingleCommand.Flag("image-id", "Container name to fetch scan results for").Default("").String()
+	reportSingleContainerTag    = reportSingleCommand.Flag("image-tag", "Container tag to fetch scan results for").Default("").String()
+	reportSingleContainerDigest = reportSingleCommand.Flag("image-digest", "Container digest (sha256:<hash>) to fetch scan results for. Takes precedence over image-tag.").Default("").String()
 
 	reportCompositionCommand     = reportCommand.Command("composition", "Iterate over a user supplied list of Images (composition)")
-	reportCompositionFile        = reportCompositionCommand.Flag("compositionfile", "ZD Composition file to load.").Default("").String()
+	reportCompositionFile        = reportCompositionCommand.Flag("compositionfile", "Composition file to load, '-' to read from stdin.").Default("").String()
 	reportCompisotionStripPrefix = reportCompositionCommand.Flag("strip-prefix", "Prefix string to strip while parsing composition entries. Removes first occurrence of substring.").Default("").String()
 	reportCompositionStripSuffix = reportCompositionCommand.Flag("strip-suffix", "Suffix string to strip while pasrsing composition entries. Removes last occurrence of substring.").Default("_version").String()
+	reportCompositionFormat      = reportCompositionCommand.Flag("format", "Format of the composition file: zd, docker-compose, kubernetes, ecs or image-list.").Default(helpers.CompositionFormatZD).Enum(helpers.CompositionFormatZD, helpers.CompositionFormatDockerCompose, helpers.CompositionFormatKubernetes, helpers.CompositionFormatECS, helpers.CompositionFormatImageList)
 
-	//TODO: Implement hash based findings, Probably requires further abstraction of *ecrDescribeImageScanFindingsInput
-	//containerHash =  kingpin.Flag("hash", "Container hash to fetch scan results for").Envar("ESU_ECR_CONTAINER_HASH").String()
-	//TODO: make reporter config read a fucking yaml as option.
-	//reporterConfigFile = reportCommand.Flag("reporter", "Configuration file for configuring reporters").Envar("ESU_REPORTER_CONFIG").Default("").String()
+	allowlistCommand         = kingpin.Command("allowlist", "Inspect allowlist files")
+	allowlistCheckCommand    = allowlistCommand.Command("check", "Check an allowlist for syntax errors, container keys that match no repository and entries that match no findings in the latest scans")
+	allowlistCheckFile       = allowlistCheckCommand.Flag("allowlist", "Allowlist file to check").Default("").String()
+	allowlistCheckSyntaxOnly = allowlistCheckCommand.Flag("syntax-only", "Only check the syntax of the allowlist, does not require access to ECR").Default("false").Bool()
 )
 
 func main() {
+	//Load optional configuration file and use it's values as defaults before parsing arguments
+	config := applyConfigFile()
+
 	//Parse arguments
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	//Setup shared logger
 	L := logger.Init("ESU Logger", *verbose, false, ioutil.Discard)
 	logger.SetFlags(log.LUTC)
 
-	//Load and create optional allowlist
-	allowlist, err := helpers.CreateAllowlist(*reportAllowlistFile, *L)
-	helpers.Check(err, L, "Failed to return allowlist.")
+	//Load and create optional allowlist and the reporter(s) every report is fanned out to. Only used by the report
+	//commands, allowlist check loads and reports on its own file.
+	var allowlist helpers.Allowlist
+	var reporterList []reporters.Reporter
+	var err error
+	if strings.HasPrefix(command, reportCommand.FullCommand()+" ") {
+		allowlist, err = helpers.CreateAllowlist(*reportAllowlistFile, *L)
+		helpers.CheckAndExit(err, L, "Failed to load allowlist %s: %v", *reportAllowlistFile, err)
+
+		reporterList, err = reporters.NewReporters(*reportReporters)
+		helpers.CheckAndExit(err, L, "Failed to create reporters: %v", err)
 
-	//Configuring and creating shared session
-	awsConfig := helpers.NewDefaultAwsConfig(region)
+		err = helpers.NewScanConfig(*reportStartScan, *reportScanTimeout, *reportScanPollInterval, *reportScanMaxPollInterval).Validate()
+		helpers.CheckAndExit(err, L, "Invalid scan settings: %v", err)
+	}
+
+	//Settings used to determine the latest tag of a repository
+	tagSelection, err := helpers.NewTagSelection(*latestTagFilter, *tagInclude, *tagExclude, *latestStrategy, *latestRegex, config.TagOverrides)
+	helpers.CheckAndExit(err, L, "Invalid latest tag settings: %v", err)
+	tagSelection.Count = *reportLatestCount
+	tagSelection.Within, err = helpers.ParseDuration(*reportPushedWithin)
+	helpers.CheckAndExit(err, L, "Invalid pushed-within: %v", err)
+
+	//Configuring and creating shared session and ECR client
+	awsConfig := helpers.NewDefaultAwsConfig(region, *maxRetries)
 	s, sErr := session.NewSession(&awsConfig)
 	helpers.Check(sErr, L, "Failed to create session.")
+	svc := ecr.New(s)
 	//
 	if *registryId == "" {
 		registryId = nil
 	}
-	switch kingpin.Parse() {
+	// Keep track of outcome of every image to determine exit code
+	status := helpers.NewRunStatus()
+	switch command {
 
 	case reportAllCommand.FullCommand():
-		err = doReportAll(&allowlist, s, L)
+		err = doReportAll(&allowlist, reporterList, tagSelection, status, svc, L)
 		helpers.CheckAndExit(err, L)
 
 	case reportSingleCommand.FullCommand():
-		err = doReportSingle(allowlist, s, L)
+		err = doReportSingle(allowlist, reporterList, tagSelection, status, svc, L)
 		helpers.CheckAndExit(err, L)
 
 	case reportCompositionCommand.FullCommand():
-		config := helpers.NewCompositionConfig(reportCompositionFile, baseRepo, reportCompisotionStripPrefix, reportCompositionStripSuffix)
-		cl, err := helpers.CompositionParser(&config, registryId, L)
-		helpers.CheckAndExit(err, L, "Failed to Parse file to extract list of images to iterate on")
-		err = doReportComposition(cl, &allowlist, s, L)
+		compositionConfig := helpers.NewCompositionConfig(reportCompositionFile, baseRepo, reportCompisotionStripPrefix, reportCompositionStripSuffix, reportCompositionFormat, region)
+		cl, err := helpers.CompositionParser(&compositionConfig, registryId, L)
+		helpers.CheckAndExit(err, L, "Failed to Parse file to extract list of images to iterate on: %v", err)
+		err = doReportComposition(cl, &allowlist, reporterList, tagSelection, status, svc, L)
 		helpers.CheckAndExit(err, L)
+
+	case allowlistCheckCommand.FullCommand():
+		os.Exit(doAllowlistCheck(tagSelection, svc, L))
 	}
+	status.LogSummary(L)
+	os.Exit(status.ExitCode(*reportFailOn))
 }
 
-func doReportAll(w *helpers.Allowlist, s *session.Session, l *logger.Logger) error {
+// applyConfigFile looks up the --config flag (or ESU_CONFIG) before arguments are parsed and uses the values in that
+// file as defaults for the matching flags, so flags and environment variables still take precedence. Returns the
+// helpers.Config for settings that have no flag.
+func applyConfigFile() helpers.Config {
+	filename := os.Getenv("ESU_CONFIG")
+	if context, _ := kingpin.CommandLine.ParseContext(os.Args[1:]); context != nil {
+		for _, element := range context.Elements {
+			if flag, ok := element.Clause.(*kingpin.FlagClause); ok && flag.Model().Name == "config" && element.Value != nil {
+				filename = *element.Value
+			}
+		}
+	}
+	config, err := helpers.LoadConfig(filename)
+	kingpin.FatalIfError(err, "Failed to load configuration file %s", filename)
+
+	commands := map[string]*kingpin.CmdClause{
+		"report":             reportCommand,
+		"report all":         reportAllCommand,
+		"report single":      reportSingleCommand,
+		"report composition": reportCompositionCommand,
+		"allowlist check":    allowlistCheckCommand,
+	}
+	for command, flags := range helpers.ConfigFlagDefaults(config) {
+		for name, values := range flags {
+			var flag *kingpin.FlagClause
+			if command == "" {
+				flag = kingpin.CommandLine.GetFlag(name)
+			} else {
+				flag = commands[command].GetFlag(name)
+			}
+			if flag != nil {
+				flag.Default(values...)
+			}
+		}
+	}
+	return config
+}
+
+// reportJob describes a single image to report on.
+type reportJob struct {
+	image        ecr.Image
+	latestTag    bool // latestTag: Resolve the most recent tag of the repository before retrieving results
+	skipUntagged bool // skipUntagged: Skip the image instead of recording an error when no (matching) tag can be found
+	history      bool // history: Report on every image selected by the Count and Within of the helpers.TagSelection instead of only the latest tag
+}
+
+func doReportAll(w *helpers.Allowlist, reporterList []reporters.Reporter, tagSelection helpers.TagSelection, status *helpers.RunStatus, svc *ecr.ECR, l *logger.Logger) error {
+	repositoryFilter, err := helpers.NewRepositoryFilter(*reportAllRepositoryInclude, *reportAllRepositoryExclude, *reportAllRepositoryTags)
+	if err != nil {
+		return fmt.Errorf("invalid repository filter: %v", err)
+	}
 	//Grab all repo's
-	allRepositories, err := helpers.GetEcrRepositories(registryId, s, *l)
-	helpers.Check(err, l)
+	allRepositories, err := helpers.GetEcrRepositories(registryId, svc, *l)
+	if err != nil {
+		l.Errorf("Failed to list repositories: %v", err)
+		status.RecordError("repositories")
+		return nil
+	}
+	jobs := make([]reportJob, 0, len(allRepositories))
 	for r := range allRepositories {
-		image := ecr.Image{
-			RepositoryName: allRepositories[r].RepositoryName,
-			RegistryId:     registryId,
-			ImageId: &ecr.ImageIdentifier{
-				ImageTag: nil,
-			},
+		// Filter on name first, resource tags require an api call per repository.
+		container := strings.TrimPrefix(*allRepositories[r].RepositoryName, fmt.Sprintf("%s/", *baseRepo))
+		if !repositoryFilter.Matches(container) {
+			continue
 		}
-		image.ImageId.ImageTag, err = helpers.GetLatestTag(
-			&ecr.Repository{
-				RegistryId:     image.RegistryId,
-				RepositoryName: image.RepositoryName,
-			}, latestTagFilter, s, l)
-		if err == nil {
-			_ = createReport(&image, w, s, l)
+		if len(repositoryFilter.Tags) > 0 {
+			tags, err := helpers.GetRepositoryTags(allRepositories[r], svc, l)
+			if err != nil {
+				status.RecordError(*allRepositories[r].RepositoryName)
+				continue
+			}
+			if !repositoryFilter.MatchesTags(tags) {
+				continue
+			}
 		}
+		jobs = append(jobs, reportJob{
+			image: ecr.Image{
+				RepositoryName: allRepositories[r].RepositoryName,
+				RegistryId:     registryId,
+				ImageId: &ecr.ImageIdentifier{
+					ImageTag: nil,
+				},
+			},
+			latestTag:    true,
+			skipUntagged: true,
+			history:      tagSelection.History(),
+		})
 	}
+	l.Infof("Reporting on %d of %d repositories", len(jobs), len(allRepositories))
+	reportImages(jobs, w, reporterList, tagSelection, status, svc, l)
 	return nil
 
 }
 
-func doReportSingle(allowlist helpers.Allowlist, s *session.Session, l *logger.Logger) (err error) {
-	image := helpers.NewImageDefinition(registryId, *reportSingleContainerName, *reportSingleContainerTag)
-	if *latestTag == true {
-		image.ImageId.ImageTag, err = helpers.GetLatestTag(&ecr.Repository{
-			RegistryId:     image.RegistryId,
-			RepositoryName: image.RepositoryName,
-		}, latestTagFilter, s, l)
+func doReportSingle(allowlist helpers.Allowlist, reporterList []reporters.Reporter, tagSelection helpers.TagSelection, status *helpers.RunStatus, svc *ecr.ECR, l *logger.Logger) (err error) {
+	imageReference := *reportSingleContainerTag
+	if *reportSingleContainerDigest != "" {
+		imageReference = *reportSingleContainerDigest
 	}
-
+	image := helpers.NewImageDefinition(registryId, *reportSingleContainerName, imageReference)
 	if *baseRepo != "" {
 		image.RepositoryName = aws.String(strings.Join([]string{*baseRepo, *reportSingleContainerName}, "/"))
 
 	}
-	return createReport(&image, &allowlist, s, l)
+	job := reportJob{image: image, latestTag: *latestTag || tagSelection.History(), history: tagSelection.History()}
+	reportImages([]reportJob{job}, &allowlist, reporterList, tagSelection, status, svc, l)
+	return nil
 }
 
-func doReportComposition(images []ecr.Image, allowlist *helpers.Allowlist, session *session.Session, l *logger.Logger) (err error) {
+func doReportComposition(images []ecr.Image, allowlist *helpers.Allowlist, reporterList []reporters.Reporter, tagSelection helpers.TagSelection, status *helpers.RunStatus, svc *ecr.ECR, l *logger.Logger) (err error) {
+	jobs := make([]reportJob, 0, len(images))
 	for i := range images {
-		if *latestTag {
-			images[i].ImageId.ImageTag, err = helpers.GetLatestTag(&ecr.Repository{
-				RepositoryName: images[i].RepositoryName,
-			}, latestTagFilter, session, l)
+		jobs = append(jobs, reportJob{image: images[i], latestTag: *latestTag})
+	}
+	reportImages(jobs, allowlist, reporterList, tagSelection, status, svc, l)
+	return nil
+}
+
+// reportImages retrieves results for every reportJob using a pool of --concurrency workers sharing a single ECR client.
+// Reports are written in the order of the jobs (as soon as results for all preceding jobs are written) so output
+// remains deterministic regardless of concurrency.
+func reportImages(jobs []reportJob, allowlist *helpers.Allowlist, reporterList []reporters.Reporter, tagSelection helpers.TagSelection, status *helpers.RunStatus, svc *ecr.ECR, l *logger.Logger) {
+	concurrency := *reportConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// Repositories that are part of multiple jobs (like a composition containing a repository at two tags) get the tag
+	// in their file names, so reports of the same repository do not overwrite each other.
+	repositoryJobs := make(map[string]int)
+	for i := range jobs {
+		repositoryJobs[aws.StringValue(jobs[i].image.RepositoryName)]++
+	}
+
+	// Every job gets its own buffered channel so workers never block on writing a result.
+	results := make([]chan []reporters.ImageScanReport, len(jobs))
+	for i := range results {
+		results[i] = make(chan []reporters.ImageScanReport, 1)
+	}
+
+	queue := make(chan int)
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			for i := range queue {
+				results[i] <- fetchReports(&jobs[i], allowlist, tagSelection, status, svc, l)
+			}
+		}()
+	}
+	go func() {
+		for i := range jobs {
+			queue <- i
 		}
-		if err == nil {
-			_ = createReport(&images[i], allowlist, session, l)
+		close(queue)
+	}()
+
+	for i := range results {
+		for _, report := range <-results[i] {
+			name := *report.Image.RepositoryName
+			if jobs[i].history || repositoryJobs[name] > 1 {
+				name = fmt.Sprintf("%s-%s", name, imageVersion(report.Image))
+			}
+			writeReports(report, name, reporterList, status, l)
 		}
 	}
-	return nil
+	finishReports(reporterList, status, l)
+}
+
+// imageVersion returns the tag of an ecr.Image, or a short digest for images without a tag, for use in file names.
+func imageVersion(image *ecr.Image) string {
+	if tag := aws.StringValue(image.ImageId.ImageTag); tag != "" {
+		return tag
+	}
+	digest := strings.TrimPrefix(aws.StringValue(image.ImageId.ImageDigest), "sha256:")
+	if len(digest) > 12 {
+		digest = digest[:12]
+	}
+	return digest
+}
+
+// fetchReports resolves the tag(s) of the image in a reportJob and retrieves a report for every resulting image.
+// Returns no reports (after recording the outcome in the helpers.RunStatus) when there is nothing to report on.
+func fetchReports(job *reportJob, allowlist *helpers.Allowlist, tagSelection helpers.TagSelection, status *helpers.RunStatus, svc *ecr.ECR, l *logger.Logger) (reports []reporters.ImageScanReport) {
+	image := &job.image
+	// We convert repositoryName back into base name to keep allowlist and tag overrides readable
+	container := strings.TrimPrefix(*image.RepositoryName, fmt.Sprintf("%s/", *baseRepo))
+	repository := &ecr.Repository{
+		RegistryId:     image.RegistryId,
+		RepositoryName: image.RepositoryName,
+	}
+
+	tags := []*string{image.ImageId.ImageTag}
+	if job.latestTag {
+		var err error
+		image.ImageId.ImageDigest = nil
+		if job.history {
+			tags, err = helpers.GetLatestTags(repository, tagSelection.ForRepository(container), svc, l)
+		} else {
+			tags = []*string{nil}
+			tags[0], err = helpers.GetLatestTag(repository, tagSelection.ForRepository(container), svc, l)
+		}
+		if err != nil {
+			// Repositories without (matching) tags are skipped by report all, failing to query them is an error.
+			if !job.skipUntagged || !errors.Is(err, helpers.ErrNoTags) {
+				l.Errorf("Failed to determine latest tag of %s: %v", *image.RepositoryName, err)
+				status.RecordError(helpers.FormatImageReference(image))
+			}
+			return nil
+		}
+		if len(tags) == 0 {
+			l.Infof("No images of %s were pushed within %v", *image.RepositoryName, tagSelection.Within)
+			return nil
+		}
+	}
+
+	for _, tag := range tags {
+		tagged := *image
+		tagged.ImageId = &ecr.ImageIdentifier{ImageTag: tag, ImageDigest: image.ImageId.ImageDigest}
+		if report := fetchReport(&tagged, container, allowlist, status, svc, l); report != nil {
+			reports = append(reports, *report)
+		}
+	}
+	return reports
 }
 
-func createReport(image *ecr.Image, allowlist *helpers.Allowlist, session *session.Session, l *logger.Logger) error {
-	reporterConfig := helpers.NewCustomReporterConfig(helpers.FileNameFormatter(*image.RepositoryName, "xml"), fmt.Sprintf("%s/", *reportDir), *reportReporters)
-	n := fmt.Sprintf("%s:%s", *image.RepositoryName, *image.ImageId.ImageTag)
+// fetchReport resolves the digest of an image, retrieves its scan results and evaluates them against the cutoff and
+// allowlist. Returns nil (after recording the outcome in the helpers.RunStatus) when there is nothing to report on.
+func fetchReport(image *ecr.Image, container string, allowlist *helpers.Allowlist, status *helpers.RunStatus, svc *ecr.ECR, l *logger.Logger) *reporters.ImageScanReport {
+	scanConfig := helpers.NewScanConfig(*reportStartScan, *reportScanTimeout, *reportScanPollInterval, *reportScanMaxPollInterval)
+
+	// Resolve tags to digests (and vice versa) so the report records the immutable digest alongside the tag.
+	if err := helpers.ResolveImageDigest(image, svc, l); err != nil {
+		l.Warningf("Failed to resolve digest for %s: %v", helpers.FormatImageReference(image), err)
+	}
+	n := helpers.FormatImageReference(image)
 
 	// Flatten global allowlist and component specific allowlist into a single array.
-	// We convert repositoryName back into base name to keep allowlist readable
-	componentAllowlist := helpers.FlattenAllowlist(allowlist, strings.TrimPrefix(*image.RepositoryName, fmt.Sprintf("%s/", *baseRepo)))
+	componentAllowlist := helpers.FlattenAllowlist(allowlist, container)
 
 	l.Info("Getting Results for container: ", n)
-	result, err := aggregator.EcrGetScanResults(image, session, l)
+	result, err := aggregator.EcrGetScanResults(image, scanConfig, svc, l)
 	if err != nil {
-		return err
-	} else if *result.ImageScanStatus.Status != "FAILED" {
-		l.Infof("Got results")
-		if reporterConfig.ReporterType == "junit" {
-			l.Infof("Creating junit test report")
-
-			re := reporters.CreateXmlReport(*image.RepositoryName, *reportSeverityCutoff, *result.ImageScanFindings, reporterConfig, &componentAllowlist, l)
-			helpers.Check(re, l, "Failed to write report for %s:%s", image.RepositoryName, image.ImageId.ImageTag)
+		if aggregator.IsScanUnavailable(err) {
+			status.RecordScanFailure(n)
+		} else {
+			status.RecordError(n)
 		}
-	} else {
+		return nil
+	} else if *result.ImageScanStatus.Status == ecr.ScanStatusInProgress {
+		l.Warningf("Scan for %s is still in progress, use --start-scan to wait for it to complete", n)
+		status.RecordScanFailure(n)
+		return nil
+	} else if *result.ImageScanStatus.Status == "FAILED" {
 		l.Warningf("Scan failed for %s: %v", n, *result.ImageScanStatus.Description)
+		status.RecordScanFailure(n)
+		return nil
+	}
+	l.Infof("Got results for %s", n)
+	report := reporters.NewImageScanReport(image, result, *reportSeverityCutoff, &componentAllowlist)
+	if reporters.CountFailedFindings(report) > 0 {
+		status.RecordFindings(n)
+	}
+	return &report
+}
+
+// writeReports fans an ImageScanReport out to every reporter (naming files after name), recording an error in the
+// helpers.RunStatus for every reporter that fails.
+func writeReports(report reporters.ImageScanReport, name string, reporterList []reporters.Reporter, status *helpers.RunStatus, l *logger.Logger) {
+	n := helpers.FormatImageReference(report.Image)
+	for i := range reporterList {
+		reporterConfig := newReporterConfig(reporterList[i], helpers.FileNameFormatter(name, reporterList[i].FileExtension()))
+		if err := reporterList[i].CreateReport(report, reporterConfig, l); err != nil {
+			l.Errorf("Failed to write %s report for %s: %v", reporterList[i].Name(), n, err)
+			status.RecordError(n)
+		}
+	}
+}
+
+// finishReports lets every reporter that implements reporters.RunReporter write out its report covering every image,
+// recording an error in the helpers.RunStatus for every reporter that fails.
+func finishReports(reporterList []reporters.Reporter, status *helpers.RunStatus, l *logger.Logger) {
+	for i := range reporterList {
+		runReporter, ok := reporterList[i].(reporters.RunReporter)
+		if !ok {
+			continue
+		}
+		if err := runReporter.FinishRun(newReporterConfig(reporterList[i], ""), l); err != nil {
+			l.Errorf("Failed to write aggregated %s report: %v", reporterList[i].Name(), err)
+			status.RecordError(fmt.Sprintf("%s report", reporterList[i].Name()))
+		}
+	}
+}
+
+// newReporterConfig creates the helpers.ReporterConfig for a reporter writing to a file (if applicable) in the output
+// directory.
+func newReporterConfig(reporter reporters.Reporter, fileName string) helpers.ReporterConfig {
+	reporterConfig := helpers.NewCustomReporterConfig(fileName, fmt.Sprintf("%s/", *reportDir), reporter.Name())
+	reporterConfig.JSONLinesOutput = *reportJSONLinesOutput
+	reporterConfig.Elasticsearch = helpers.NewElasticsearchConfig(*reportEsURL, *reportEsIndex, *reportEsUsername, *reportEsPassword, *reportEsAPIKey)
+	reporterConfig.JUnit = helpers.NewJUnitConfig(*reportJUnitAggregateFile, *reportJUnitPerImage)
+	return reporterConfig
+}
+
+// doAllowlistCheck checks the syntax of an allowlist and (unless --syntax-only is passed) compares it against the
+// repositories in the registry and the findings in the scans of their latest tags. Returns the exit code: 1 for an
+// invalid allowlist (or when the registry can not be queried), 3 when container keys or entries are unused.
+func doAllowlistCheck(tagSelection helpers.TagSelection, svc *ecr.ECR, l *logger.Logger) int {
+	if *allowlistCheckFile == "" {
+		l.Error("No allowlist supplied, use --allowlist")
+		return helpers.ExitCodeError
+	}
+	allowlist, err := helpers.CreateAllowlist(*allowlistCheckFile, *l)
+	if err != nil {
+		l.Errorf("%s is not a valid allowlist: %v", *allowlistCheckFile, err)
+		return helpers.ExitCodeError
+	}
+	l.Infof("%s is a valid allowlist", *allowlistCheckFile)
+	if *allowlistCheckSyntaxOnly {
+		return helpers.ExitCodeOK
+	}
+
+	repositories, err := helpers.GetEcrRepositories(registryId, svc, *l)
+	if err != nil {
+		l.Errorf("Failed to list repositories: %v", err)
+		return helpers.ExitCodeError
+	}
+	audit := helpers.NewAllowlistAudit(&allowlist)
+	complete := true
+	for r := range repositories {
+		// We convert repositoryName back into base name to match the allowlist, like fetchReport does
+		container := strings.TrimPrefix(*repositories[r].RepositoryName, fmt.Sprintf("%s/", *baseRepo))
+		audit.RecordContainer(container)
+		if len(allowlist.MatchingContainerKeys(container)) == 0 && len(allowlist.GlobalPackages) == 0 {
+			continue
+		}
+
+		tag, err := helpers.GetLatestTag(repositories[r], tagSelection.ForRepository(container), svc, l)
+		if err != nil {
+			// Repositories without (matching) tags have no findings, failing to query them leaves the audit incomplete.
+			if !errors.Is(err, helpers.ErrNoTags) {
+				l.Warningf("Failed to determine latest tag of %s, entries only matching its findings are reported as unused: %v", *repositories[r].RepositoryName, err)
+				complete = false
+			}
+			continue
+		}
+		image := helpers.NewImageDefinition(repositories[r].RegistryId, *repositories[r].RepositoryName, *tag)
+		result, err := aggregator.EcrGetScanResults(&image, helpers.ScanConfig{}, svc, l)
+		if err != nil {
+			l.Warningf("Failed to retrieve scan results for %s, entries only matching its findings are reported as unused", helpers.FormatImageReference(&image))
+			complete = false
+			continue
+		}
+		if result.ImageScanStatus == nil || aws.StringValue(result.ImageScanStatus.Status) != ecr.ScanStatusComplete {
+			// Failed and running scans have no findings, counting them would report every entry they match as unused.
+			l.Warningf("Scan of %s did not complete, entries only matching its findings are reported as unused", helpers.FormatImageReference(&image))
+			complete = false
+			continue
+		}
+		report := reporters.NewImageScanReport(&image, result, "", &[]helpers.AllowlistEntry{})
+		for _, finding := range report.Findings {
+			audit.RecordFinding(container, finding.Name, finding.Package)
+		}
+	}
+
+	unmatchedKeys := audit.UnmatchedContainerKeys()
+	for _, key := range unmatchedKeys {
+		l.Warningf("Container key %s does not match any repository", key)
+	}
+	unusedEntries := audit.UnusedEntries()
+	for _, entry := range unusedEntries {
+		l.Warningf("Allowlist entry %s (%s) does not match any finding in the latest scans", entry, entry.Scope)
+	}
+	if !complete {
+		l.Warning("Not all scan results could be retrieved, unused entries may be incomplete")
+	}
+	if len(unmatchedKeys) > 0 || len(unusedEntries) > 0 {
+		l.Warningf("%d unmatched container key(s) and %d unused entries in %s", len(unmatchedKeys), len(unusedEntries), *allowlistCheckFile)
+		return helpers.ExitCodeFindings
 	}
-	return err
+	l.Infof("Every container key and entry in %s is in use", *allowlistCheckFile)
+	return helpers.ExitCodeOK
 }
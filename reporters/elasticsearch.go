@@ -1,36 +1,231 @@
 package reporters
 
 import (
-	"github.com/aws/aws-sdk-go/service/ecr"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/google/logger"
 	"github.com/kiwivogel/ecr-scan-util/helpers"
 )
 
+// VulnerabilityReport is the document we index in Elasticsearch for every individual finding.
 type VulnerabilityReport struct {
-	Image          string
-	ImageTag       string
-	Name           string `json:"name"`
-	Severity       string `json:"severity"`
-	URI            string `json:"uri"`
-	PackageName    string
-	PackageVersion string
-}
-
-func CreateNewVulnerabilityReport(imageName string, imageTag string, finding *ecr.ImageScanFinding) (findingReport VulnerabilityReport, err error) {
-	// if errors this is caused by an unexpected lack of package_name or package_version in a finding, this could technically
-	// happen if something is wrong on AWS's side.
-	packageName, err := helpers.ExtractPackageAttributes("package_name", finding)
-	packageVersion, err := helpers.ExtractPackageAttributes("package_version", finding)
+	Timestamp       time.Time  `json:"@timestamp"`                  //Time of the scan (or of the report when the scan time is unknown)
+	Registry        string     `json:"registry,omitempty"`          //Registry (AWS account) id of the image, empty for the default registry
+	Image           string     `json:"image"`                       //Repository name of the image
+	ImageTag        string     `json:"image_tag,omitempty"`         //Tag of the image
+	ImageDigest     string     `json:"image_digest,omitempty"`      //Digest of the image
+	Name            string     `json:"name"`                        //Name of the vulnerability (usually the CVE identifier)
+	Severity        string     `json:"severity"`                    //Severity as reported by ECR
+	URI             string     `json:"uri"`                         //URI with more information on the vulnerability
+	Description     string     `json:"description,omitempty"`       //Description of the vulnerability
+	PackageName     string     `json:"package_name"`                //Name of the vulnerable package
+	PackageVersion  string     `json:"package_version"`             //Version of the vulnerable package
+	Cutoff          string     `json:"cutoff"`                      //Cutoff used to evaluate the finding
+	PassedCutoff    bool       `json:"passed_cutoff"`               //Whether the severity is below the cutoff
+	NeedsReview     bool       `json:"needs_review"`                //Whether the severity can not be compared to the cutoff and requires manual review
+	AllowListed     bool       `json:"allowlisted"`                 //Whether the finding matched an allowlist entry
+	AllowListHit    string     `json:"allowlist_match,omitempty"`   //Allowlist entry the finding matched
+	ScanCompletedAt *time.Time `json:"scan_completed_at,omitempty"` //Time the scan completed
+}
+
+// elasticsearchBulkAction is the action line preceding every document in a _bulk request.
+type elasticsearchBulkAction struct {
+	Index struct {
+		Index string `json:"_index"`
+		ID    string `json:"_id"`
+	} `json:"index"`
+}
+
+// elasticsearchBulkResponse contains the parts of a _bulk response we use to detect failures of individual documents.
+type elasticsearchBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// elasticsearchReporter is the Reporter indexing one VulnerabilityReport per finding using the _bulk api.
+type elasticsearchReporter struct {
+	client *http.Client
+}
+
+// newElasticsearchReporter returns a Reporter indexing findings in Elasticsearch.
+func newElasticsearchReporter() Reporter {
+	return elasticsearchReporter{
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Name returns the name used to select the elasticsearch reporter.
+func (elasticsearchReporter) Name() string {
+	return "elasticsearch"
+}
+
+// FileExtension returns an empty string since the elasticsearch reporter does not write files.
+func (elasticsearchReporter) FileExtension() string {
+	return ""
+}
+
+// CreateReport bulk indexes a VulnerabilityReport for every finding in an ImageScanReport in the index (pattern)
+// supplied in the helpers.ReporterConfig. Returns an error when the request fails or any document was rejected.
+func (r elasticsearchReporter) CreateReport(report ImageScanReport, config helpers.ReporterConfig, l *logger.Logger) error {
+	if len(report.Findings) == 0 {
+		l.Infof("No findings to index for %s", helpers.FormatImageReference(report.Image))
+		return nil
+	}
+	timestamp := time.Now().UTC()
+	if report.ScanCompletedAt != nil {
+		timestamp = report.ScanCompletedAt.UTC()
+	}
+	index := formatIndexName(config.Elasticsearch.Index, timestamp)
+
+	body, err := createBulkBody(report, index, timestamp)
+	if err != nil {
+		return err
+	}
+	l.Infof("Indexing %d findings for %s in %s", len(report.Findings), helpers.FormatImageReference(report.Image), index)
+	return r.sendBulkRequest(config.Elasticsearch, body)
+}
+
+// CreateNewVulnerabilityReport converts an evaluated Finding of an ImageScanReport into a VulnerabilityReport timestamped
+// with the supplied timestamp.
+func CreateNewVulnerabilityReport(report ImageScanReport, finding Finding, timestamp time.Time) VulnerabilityReport {
+	return VulnerabilityReport{
+		Timestamp:       timestamp,
+		Registry:        aws.StringValue(report.Image.RegistryId),
+		Image:           aws.StringValue(report.Image.RepositoryName),
+		ImageTag:        aws.StringValue(report.Image.ImageId.ImageTag),
+		ImageDigest:     aws.StringValue(report.Image.ImageId.ImageDigest),
+		Name:            finding.Name,
+		Severity:        finding.Severity,
+		URI:             finding.URI,
+		Description:     finding.Description,
+		PackageName:     finding.PackageName,
+		PackageVersion:  finding.PackageVersion,
+		Cutoff:          report.Cutoff,
+		PassedCutoff:    finding.PassedCutoff,
+		NeedsReview:     finding.NeedsReview,
+		AllowListed:     finding.AllowListed,
+		AllowListHit:    finding.AllowListHit,
+		ScanCompletedAt: report.ScanCompletedAt,
+	}
+}
+
+// createBulkBody creates the newline delimited body of a _bulk request containing an index action and a
+// VulnerabilityReport for every finding in an ImageScanReport.
+func createBulkBody(report ImageScanReport, index string, timestamp time.Time) ([]byte, error) {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for f := range report.Findings {
+		document := CreateNewVulnerabilityReport(report, report.Findings[f], timestamp)
+
+		action := elasticsearchBulkAction{}
+		action.Index.Index = index
+		action.Index.ID = documentID(document)
+
+		// json.Encoder terminates every value with a newline which is exactly what the _bulk api expects.
+		if err := encoder.Encode(action); err != nil {
+			return nil, err
+		}
+		if err := encoder.Encode(document); err != nil {
+			return nil, err
+		}
+	}
+	return body.Bytes(), nil
+}
+
+// sendBulkRequest posts a _bulk body to the cluster configured in a helpers.ElasticsearchConfig using either API key or
+// basic authentication. Returns an error if the request fails or any of the documents was rejected.
+func (r elasticsearchReporter) sendBulkRequest(config helpers.ElasticsearchConfig, body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(config.URL, "/")+"/_bulk", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	if config.APIKey != "" {
+		request.Header.Set("Authorization", "ApiKey "+config.APIKey)
+	} else if config.Username != "" {
+		request.SetBasicAuth(config.Username, config.Password)
+	}
+
+	response, err := r.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return VulnerabilityReport{
-			Image:          imageName,
-			ImageTag:       imageTag,
-			Name:           *finding.Name,
-			Severity:       *finding.Severity,
-			URI:            *finding.Uri,
-			PackageName:    packageName,
-			PackageVersion: packageVersion,
-		}, err
-	} else {
-		return VulnerabilityReport{}, err
+		return err
 	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("bulk request to %s failed with status %s: %s", config.URL, response.Status, responseBody)
+	}
+
+	bulkResponse := elasticsearchBulkResponse{}
+	if err := json.Unmarshal(responseBody, &bulkResponse); err != nil {
+		return fmt.Errorf("failed to parse bulk response: %v", err)
+	}
+	if bulkResponse.Errors {
+		return bulkResponseError(bulkResponse)
+	}
+	return nil
+}
+
+// bulkResponseError returns an error describing how many documents in a _bulk response were rejected and why the first
+// of them was rejected.
+func bulkResponseError(bulkResponse elasticsearchBulkResponse) error {
+	failed := 0
+	reason := ""
+	for i := range bulkResponse.Items {
+		for _, item := range bulkResponse.Items[i] {
+			if item.Status > 299 {
+				failed++
+				if reason == "" {
+					reason = fmt.Sprintf("%s: %s", item.Error.Type, item.Error.Reason)
+				}
+			}
+		}
+	}
+	return fmt.Errorf("%d of %d documents were rejected, first error: %s", failed, len(bulkResponse.Items), reason)
+}
+
+// formatIndexName replaces a date pattern between braces (using Go's time layout) in an index name with the supplied
+// timestamp, e.g. ecr-scans-{2006.01.02} becomes ecr-scans-2020.01.08. Index names without braces are returned as is.
+func formatIndexName(pattern string, timestamp time.Time) string {
+	start := strings.Index(pattern, "{")
+	end := strings.LastIndex(pattern, "}")
+	if start == -1 || end < start {
+		return pattern
+	}
+	return pattern[:start] + timestamp.Format(pattern[start+1:end]) + pattern[end+1:]
+}
+
+// documentID creates a deterministic id for a VulnerabilityReport so indexing the results of the same scan twice
+// overwrites documents instead of duplicating them.
+func documentID(document VulnerabilityReport) string {
+	hash := sha1.Sum([]byte(strings.Join([]string{
+		document.Registry,
+		document.Image,
+		document.ImageTag,
+		document.ImageDigest,
+		document.Timestamp.Format(time.RFC3339Nano),
+		document.Name,
+		document.PackageName,
+		document.PackageVersion,
+	}, "|")))
+	return hex.EncodeToString(hash[:])
 }
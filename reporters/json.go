@@ -0,0 +1,259 @@
+package reporters
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/google/logger"
+	"github.com/kiwivogel/ecr-scan-util/helpers"
+)
+
+// Contains reporters writing out machine readable JSON (a document per image) and JSON Lines (a line per finding).
+
+// jsonSchemaVersion is increased whenever fields are removed or change meaning. Adding fields does not change the version.
+const jsonSchemaVersion = "1"
+
+// Possible outcomes of evaluating a finding against the cutoff and allowlist.
+const (
+	outcomeFailed      = "FAILED"
+	outcomePassed      = "PASSED"
+	outcomeAllowListed = "ALLOWLISTED"
+)
+
+// JSONReport is the document the json reporter writes for every image.
+type JSONReport struct {
+	SchemaVersion  string           `json:"schema_version"`  //Version of this schema
+	Image          JSONImage        `json:"image"`           //Image that was scanned
+	Scan           JSONScan         `json:"scan"`            //Status and timestamps of the scan
+	Cutoff         string           `json:"cutoff"`          //Cutoff used to evaluate the findings
+	SeverityCounts map[string]int64 `json:"severity_counts"` //Number of findings per severity
+	Findings       []JSONFinding    `json:"findings"`        //Every individual finding
+}
+
+// JSONImage describes the scanned image.
+type JSONImage struct {
+	Registry   string `json:"registry,omitempty"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+}
+
+// JSONScan describes the status and timestamps of a scan.
+type JSONScan struct {
+	Status          string     `json:"status"`
+	CompletedAt     *time.Time `json:"completed_at,omitempty"`
+	SourceUpdatedAt *time.Time `json:"vulnerability_source_updated_at,omitempty"`
+}
+
+// JSONFinding is a single finding including all its attributes and the outcome of the cutoff and allowlist evaluation.
+type JSONFinding struct {
+	Name           string            `json:"name"`
+	Severity       string            `json:"severity"`
+	URI            string            `json:"uri"`
+	Description    string            `json:"description,omitempty"`
+	PackageName    string            `json:"package_name"`
+	PackageVersion string            `json:"package_version"`
+	Attributes     map[string]string `json:"attributes"`
+	Outcome        string            `json:"outcome"` //Either FAILED, PASSED or ALLOWLISTED
+	Reason         string            `json:"reason"`  //Human readable explanation of the outcome
+	AllowListed    bool              `json:"allowlisted"`
+	AllowListHit   string            `json:"allowlist_match,omitempty"`
+}
+
+// JSONLinesFinding is a single line written by the jsonl reporter, a JSONFinding with the image and scan it belongs to.
+type JSONLinesFinding struct {
+	SchemaVersion string      `json:"schema_version"`
+	Image         JSONImage   `json:"image"`
+	Scan          JSONScan    `json:"scan"`
+	Cutoff        string      `json:"cutoff"`
+	Finding       JSONFinding `json:"finding"`
+}
+
+// jsonReporter is the Reporter writing out a JSONReport per image.
+type jsonReporter struct{}
+
+// newJSONReporter returns a Reporter writing out a JSONReport per image.
+func newJSONReporter() Reporter {
+	return jsonReporter{}
+}
+
+// Name returns the name used to select the json reporter.
+func (jsonReporter) Name() string {
+	return "json"
+}
+
+// FileExtension returns the extension used for JSON reports.
+func (jsonReporter) FileExtension() string {
+	return "json"
+}
+
+// CreateReport writes out a JSONReport for an ImageScanReport.
+func (jsonReporter) CreateReport(report ImageScanReport, config helpers.ReporterConfig, l *logger.Logger) error {
+	l.Infof("Creating json report")
+	contents, err := json.MarshalIndent(newJSONReport(report), "", "  ")
+	if err != nil {
+		return err
+	}
+	return reportFileWriter(config, "", contents, l)
+}
+
+// jsonLinesReporter is the Reporter writing out a JSONLinesFinding per line. When writing to stdout or a single file
+// (shared by all images in a run) the file is truncated on first use and writes are serialized.
+type jsonLinesReporter struct {
+	lock      *sync.Mutex
+	truncated map[string]bool
+}
+
+// newJSONLinesReporter returns a Reporter writing out a JSONLinesFinding per line.
+func newJSONLinesReporter() Reporter {
+	return jsonLinesReporter{
+		lock:      &sync.Mutex{},
+		truncated: make(map[string]bool),
+	}
+}
+
+// Name returns the name used to select the jsonl reporter.
+func (jsonLinesReporter) Name() string {
+	return "jsonl"
+}
+
+// FileExtension returns the extension used for JSON Lines reports.
+func (jsonLinesReporter) FileExtension() string {
+	return "jsonl"
+}
+
+// CreateReport writes a line per finding in an ImageScanReport to stdout, a single file or a file per image depending
+// on helpers.ReporterConfig.JSONLinesOutput.
+func (r jsonLinesReporter) CreateReport(report ImageScanReport, config helpers.ReporterConfig, l *logger.Logger) (err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var file *os.File
+	switch config.JSONLinesOutput {
+	case "-":
+		file = os.Stdout
+	case "":
+		filepath := path.Join(config.ReportBaseDir, config.ReportFileName)
+		l.Infof("writing results to %s", filepath)
+		if config.ReportBaseDir != "" {
+			if err = os.MkdirAll(config.ReportBaseDir, 0744); err != nil {
+				return err
+			}
+		}
+		if file, err = os.Create(filepath); err != nil {
+			return err
+		}
+		defer closeFile(file, &err, l)
+	default:
+		file, err = r.openSharedFile(config.JSONLinesOutput)
+		if err != nil {
+			return err
+		}
+		defer closeFile(file, &err, l)
+	}
+
+	// json.Encoder terminates every value with a newline so every finding ends up on its own line.
+	encoder := json.NewEncoder(file)
+	image := newJSONImage(report)
+	scan := newJSONScan(report)
+	for f := range report.Findings {
+		line := JSONLinesFinding{
+			SchemaVersion: jsonSchemaVersion,
+			Image:         image,
+			Scan:          scan,
+			Cutoff:        report.Cutoff,
+			Finding:       newJSONFinding(report.Cutoff, report.Findings[f]),
+		}
+		if err = encoder.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openSharedFile opens a file shared by all images in a run for appending, truncating it the first time it is opened.
+func (r jsonLinesReporter) openSharedFile(filename string) (*os.File, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !r.truncated[filename] {
+		flags = flags | os.O_TRUNC
+		r.truncated[filename] = true
+	}
+	return os.OpenFile(filename, flags, 0644)
+}
+
+// newJSONReport converts an ImageScanReport to a JSONReport.
+func newJSONReport(report ImageScanReport) (jsonReport JSONReport) {
+	jsonReport = JSONReport{
+		SchemaVersion:  jsonSchemaVersion,
+		Image:          newJSONImage(report),
+		Scan:           newJSONScan(report),
+		Cutoff:         report.Cutoff,
+		SeverityCounts: make(map[string]int64),
+		Findings:       []JSONFinding{},
+	}
+	for severity, count := range report.SeverityCounts {
+		jsonReport.SeverityCounts[severity] = aws.Int64Value(count)
+	}
+	for f := range report.Findings {
+		jsonReport.Findings = append(jsonReport.Findings, newJSONFinding(report.Cutoff, report.Findings[f]))
+	}
+	return jsonReport
+}
+
+// newJSONImage describes the image of an ImageScanReport.
+func newJSONImage(report ImageScanReport) JSONImage {
+	return JSONImage{
+		Registry:   aws.StringValue(report.Image.RegistryId),
+		Repository: aws.StringValue(report.Image.RepositoryName),
+		Tag:        aws.StringValue(report.Image.ImageId.ImageTag),
+		Digest:     aws.StringValue(report.Image.ImageId.ImageDigest),
+	}
+}
+
+// newJSONScan describes the scan of an ImageScanReport.
+func newJSONScan(report ImageScanReport) JSONScan {
+	return JSONScan{
+		Status:          report.ScanStatus,
+		CompletedAt:     report.ScanCompletedAt,
+		SourceUpdatedAt: report.SourceUpdatedAt,
+	}
+}
+
+// newJSONFinding converts a Finding to a JSONFinding, using the same cutoff and allowlist outcome as createTestCase.
+func newJSONFinding(cutoff string, finding Finding) (jsonFinding JSONFinding) {
+	jsonFinding = JSONFinding{
+		Name:           finding.Name,
+		Severity:       finding.Severity,
+		URI:            finding.URI,
+		Description:    finding.Description,
+		PackageName:    finding.PackageName,
+		PackageVersion: finding.PackageVersion,
+		Attributes:     finding.Attributes,
+		AllowListed:    finding.AllowListed,
+		AllowListHit:   finding.AllowListHit,
+	}
+	if finding.AllowListed {
+		jsonFinding.Outcome = outcomeAllowListed
+		jsonFinding.Reason = fmt.Sprintf("Matches allowlisted pattern %s", finding.AllowListHit)
+	} else if finding.NeedsReview {
+		jsonFinding.Outcome = outcomeFailed
+		jsonFinding.Reason = fmt.Sprintf("Severity %s can not be compared to cutoff %s and requires manual review", finding.Severity, cutoff)
+	} else if finding.PassedCutoff {
+		jsonFinding.Outcome = outcomePassed
+		jsonFinding.Reason = fmt.Sprintf("Severity %s below cutoff %s", finding.Severity, cutoff)
+	} else {
+		jsonFinding.Outcome = outcomeFailed
+		jsonFinding.Reason = fmt.Sprintf("Severity %s above cutoff %s", finding.Severity, cutoff)
+	}
+	if finding.AllowListExpired {
+		jsonFinding.Reason += fmt.Sprintf(", allowlist entry %s expired on %s", finding.AllowListEntry, finding.AllowListEntry.Expires)
+	} else if finding.AllowListCapped {
+		jsonFinding.Reason += fmt.Sprintf(", allowlist entry %s only allows severities up to %s", finding.AllowListEntry, finding.AllowListEntry.MaxSeverity)
+	}
+	return jsonFinding
+}
@@ -1,42 +1,66 @@
 package reporters
 
 import (
-	"bufio"
 	"encoding/xml"
 	"fmt"
-	"os"
-	"path"
+	"sync"
+	"time"
 
-	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/google/logger"
 	"github.com/kiwivogel/ecr-scan-util/helpers"
 )
 
+// JUnit formatted testsuites containing a JUnitTestSuite per image, used to write a single file for a run.
+type JUnitTestSuites struct {
+	XMLName    xml.Name         `xml:"testsuites"`    //XML header information
+	TestSuites []JUnitTestSuite `xml:"testsuite"`     //JUnitTestSuite per image
+	Name       string           `xml:"name,attr"`     //Name of the tool that created the report
+	Tests      int              `xml:"tests,attr"`    //Sum of the tests of all suites
+	Failures   int              `xml:"failures,attr"` //Sum of the failures of all suites
+	Errors     int              `xml:"errors,attr"`   //Sum of the errors of all suites
+	Skipped    int              `xml:"skipped,attr"`  //Sum of the skipped tests of all suites
+	Time       float64          `xml:"time,attr"`     //Normally duration of tests, no sense in using this here. Added to satisfy JUnit format.
+}
+
 // JUnit formatted testsuite which we abuse here as a container for individual findings (stored in this struct as JUnitTestCase)
 // We do this because this can be easilly used to view scan results in Jenkins or similar.
 type JUnitTestSuite struct {
-	XMLName   xml.Name        `xml:"testsuite"`     //XML header information
-	TestCases []JUnitTestCase `xml:"testcase"`      //List of JUnitTestCase's with additional information on the spefic fidingin
-	Name      string          `xml:"name,attr"`     //Name of container scanned
-	Tests     int             `xml:"tests,attr"`    //Number of Ignored findings (counted as passed tests)
-	Failures  int             `xml:"failures,attr"` //Number of Failures in findings
-	Errors    int             `xml:"errors,attr"`   //Number or Errors in suite
-	Time      float64         `xml:"time,attr"`     //Normally duration of test, no sense in using this here. Added to satisfy JUnit format.
+	XMLName    xml.Name         `xml:"testsuite"`            //XML header information
+	Properties *JUnitProperties `xml:"properties,omitempty"` //Properties of the scanned image such as tag and digest
+	TestCases  []JUnitTestCase  `xml:"testcase"`             //List of JUnitTestCase's with additional information on the spefic fidingin
+	Name       string           `xml:"name,attr"`            //Name of container scanned
+	Tests      int              `xml:"tests,attr"`           //Number of findings (test cases) in suite
+	Failures   int              `xml:"failures,attr"`        //Number of test cases that failed the cutoff and are not allowlisted
+	Errors     int              `xml:"errors,attr"`          //Number of test cases with an undefined severity that require manual review
+	Skipped    int              `xml:"skipped,attr"`         //Number of allowlisted test cases
+	Time       float64          `xml:"time,attr"`            //Normally duration of test, no sense in using this here. Added to satisfy JUnit format.
+}
+
+// Used to store metadata of the scanned image (such as tag, digest, registry and scan completion time) on a JUnitTestSuite.
+type JUnitProperties struct {
+	Properties []JUnitProperty `xml:"property"`
+}
+
+// A single name/value pair stored in JUnitProperties.
+type JUnitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
 }
 
 // Individual JUnitTestCase which we use to store a single finding from an ECR container scan
 type JUnitTestCase struct {
 	Name           string               `xml:"name,attr"`            //Name of the container scanned
 	ClassName      string               `xml:"classname,attr"`       //Used to store package name in this finding.
-	PassedMessage  *JUnitPassedMessage  `xml:"passed,omitempty"`     //Message if finding passes Cutoff or Allowlist
+	PassedMessage  *JUnitPassedMessage  `xml:"passed,omitempty"`     //Message if finding passes Cutoff
 	FailureMessage *JUnitFailureMessage `xml:"failure,omitempty"`    //Message if finding does not pass Cutoff
-	Skipped        *JUnitSkipped        `xml:"skipped,omitempty"`    //Message if finding is counted as skipped. Unimplemented
+	ErrorMessage   *JUnitErrorMessage   `xml:"error,omitempty"`      //Message if finding has an undefined severity
+	Skipped        *JUnitSkipped        `xml:"skipped,omitempty"`    //Message if finding is allowlisted
 	Time           float64              `xml:"time,attr"`            //Normally duration of test, no sense in using this here. Added to satisfy JUnit format.
 	SystemOut      string               `xml:"system-out,omitempty"` //Normally used for stacktrace etc. of failed test. Added to satisfy JUnit format.
 }
 
-// Used to store message for "Passed" findings. Either because they are allowlisted of because the severity is below the cutoff
-// TODO: consider splitting this across JUnitPassedMessage and JUnitSkipped (the latter for allowListed findings)
+// Used to store message for "Passed" findings, because the severity is below the cutoff
 type JUnitPassedMessage struct {
 	Message string `xml:",chardata"`
 }
@@ -47,123 +71,240 @@ type JUnitFailureMessage struct {
 	Message string `xml:",chardata"`
 }
 
-// Currently unused, see JUnitPassedMessage's TODO.
+// Used to store Message and Severity for a finding with an undefined severity, which requires manual review
+type JUnitErrorMessage struct {
+	Type    string `xml:"type,attr"`
+	Message string `xml:",chardata"`
+}
+
+// Used to store the allowlist rule an allowlisted finding matched
 type JUnitSkipped struct {
-	XMLName xml.Name `xml:"skipped"`
+	Message string `xml:"message,attr"`
 }
 
-// CreateXmlReport takes a container(name), a cutoff parameter (either 'LOW', 'MEDIUM', 'HIGH' or 'CRITICAL') a list of findings of type ecr.ImageScanFindings,
-// a helpers.ReporterConfig struct containing settings for file writeout and an allowList and writes out an XML JUnit report.
-// returns an error upon failure.
-func CreateXmlReport(container string, cutoff string, findings ecr.ImageScanFindings, config helpers.ReporterConfig, allowList *[]string, l *logger.Logger) (err error) {
+// junitReporter is the Reporter writing out JUnit XML reports using CreateXmlReport. When an aggregate file is
+// configured it also collects the JUnitTestSuite of every image to write them out as a single JUnitTestSuites.
+type junitReporter struct {
+	lock   *sync.Mutex
+	suites *[]JUnitTestSuite
+}
 
-	s := newTestSuite(container, cutoff, findings, allowList)
-	we := xmlReportWriter(config, s, l)
-	helpers.Check(we, l, "Failed to write file.\n")
-	return err
+// newJUnitReporter returns a Reporter writing out JUnit XML reports.
+func newJUnitReporter() Reporter {
+	return junitReporter{
+		lock:   &sync.Mutex{},
+		suites: &[]JUnitTestSuite{},
+	}
 }
 
-// newTestSuite generates a populated JUnitTestSuite for a container (name) for a set of ecr.ImageScanFindings failing or passing individual
-// cases based on a cutoff (either 'LOW', 'MEDIUM', 'HIGH' or 'CRITICAL') and an allowList. Returns a JUnitTestSuite.
-func newTestSuite(container string, cutoff string, findings ecr.ImageScanFindings, allowList *[]string) (testSuite JUnitTestSuite) {
-	testSuite = JUnitTestSuite{
-		XMLName:   xml.Name{container, "bla"},
-		TestCases: nil,
-		Name:      container,
-		Tests:     len(findings.Findings),
-		Failures:  countFailures(cutoff, findings.FindingSeverityCounts),
-		Errors:    int(getSeverityCount("UNDEFINED", findings.FindingSeverityCounts)),
-		Time:      0,
+// Name returns the name used to select the JUnit reporter.
+func (junitReporter) Name() string {
+	return "junit"
+}
+
+// FileExtension returns the extension used for JUnit XML reports.
+func (junitReporter) FileExtension() string {
+	return "xml"
+}
+
+// CreateReport writes out a JUnit XML report for a single image using CreateXmlReport (unless disabled in the
+// helpers.JUnitConfig) and keeps its JUnitTestSuite when an aggregate file is configured.
+func (r junitReporter) CreateReport(report ImageScanReport, config helpers.ReporterConfig, l *logger.Logger) error {
+	if config.JUnit.AggregateFile != "" {
+		r.lock.Lock()
+		*r.suites = append(*r.suites, newTestSuite(report))
+		r.lock.Unlock()
 	}
-	for f := range findings.Findings {
-		testSuite.TestCases = append(testSuite.TestCases, createTestCase(cutoff, container, *findings.Findings[f], allowList))
+	if !config.JUnit.PerImage {
+		return nil
 	}
-	return testSuite
+	l.Infof("Creating junit test report")
+	return CreateXmlReport(report, config, l)
 }
 
-// countFailures is used by newTestSuite to tally the amount of findings marked as `Failed`. Takes a cutoff (either 'LOW',
-// 'MEDIUM', 'HIGH' or 'CRITICAL') and the FindingSeverityCounts map from ecr.ImageScanFindings. Returns a flat number based
-// on cutoff parameter.
-func countFailures(cutoff string, severityCounts map[string]*int64) (failures int) {
-	var f int64 = 0
-	switch cutoff {
-	case "LOW":
-		f = getSeverityCount("LOW", severityCounts)
-		fallthrough
-	case "MEDIUM":
-		f = f + getSeverityCount("MEDIUM", severityCounts)
-		fallthrough
-	case "HIGH":
-		f = f + getSeverityCount("HIGH", severityCounts)
-		fallthrough
-	case "CRITICAL":
-		f = f + getSeverityCount("CRITICAL", severityCounts)
-	}
-	return int(f)
-}
-
-// getSeverityCount Extracts flat number from map given an index for tallying.
-func getSeverityCount(index string, severityCounts map[string]*int64) (count int64) {
-	value, present := severityCounts[index]
-	if present {
-		return *value
-	} else {
-		return 0
+// FinishRun writes out a single JUnit XML report containing the JUnitTestSuite of every image to the aggregate file
+// configured in the helpers.JUnitConfig. Does nothing when no aggregate file is configured.
+func (r junitReporter) FinishRun(config helpers.ReporterConfig, l *logger.Logger) error {
+	if config.JUnit.AggregateFile == "" {
+		return nil
 	}
-}
+	r.lock.Lock()
+	defer r.lock.Unlock()
 
-// hasPassedCutoff is a helper function used by createTestCase to compare a findings severity to the cutoff to pass or fail a test
-// returns false if counted as failed and true if passed.
-func hasPassedCutoff(cutoff string, severity string) bool {
-	severityMap := map[string]int{
-		"INFORMATIONAL": -1,
-		"LOW":           0,
-		"MEDIUM":        1,
-		"HIGH":          2,
-		"CRITICAL":      3,
+	l.Infof("Creating aggregated junit test report for %d images", len(*r.suites))
+	testSuites := newTestSuites(*r.suites)
+	formattedSuites, err := xml.MarshalIndent(testSuites, "", "\t")
+	if err != nil {
+		return err
 	}
-	return !(severityMap[severity] >= severityMap[cutoff])
+	config.ReportFileName = config.JUnit.AggregateFile
+	return reportFileWriter(config, xml.Header, formattedSuites, l)
 }
 
-// createTestCase converts a ecr.ImageScanFinding to an annotated JUnitTestCase
-// takes a cutoff (either 'LOW', 'MEDIUM', 'HIGH' or 'CRITICAL') container (name), ecr.ImageScanFinding and an allowList
-// TODO: Handle errors. (Not likely but possible if something is wrong with the data supplied by aws)
-func createTestCase(cutoff string, container string, finding ecr.ImageScanFinding, allowList *[]string) (testCase JUnitTestCase) {
-	passed := hasPassedCutoff(cutoff, *finding.Severity)
+// CreateXmlReport takes an ImageScanReport and a helpers.ReporterConfig struct containing settings for file writeout and
+// writes out an XML JUnit report.
+// returns an error upon failure.
+func CreateXmlReport(report ImageScanReport, config helpers.ReporterConfig, l *logger.Logger) (err error) {
 
-	packageName, err := helpers.ExtractPackageAttributes("package_name", &finding)
-	packageVersion, err := helpers.ExtractPackageAttributes("package_version", &finding)
+	s := newTestSuite(report)
+	return xmlReportWriter(config, s, l)
+}
 
-	packageString := fmt.Sprintf("%s@%s", packageName, packageVersion)
+// newTestSuite generates a populated JUnitTestSuite for an ImageScanReport failing or passing individual cases based on
+// the outcome of the cutoff and allowlist evaluation of every Finding. Returns a JUnitTestSuite.
+func newTestSuite(report ImageScanReport) (testSuite JUnitTestSuite) {
+	container := *report.Image.RepositoryName
+	testSuite = JUnitTestSuite{
+		XMLName:    xml.Name{Space: container, Local: "bla"},
+		Properties: newImageProperties(report),
+		TestCases:  nil,
+		Name:       container,
+		Time:       0,
+	}
+	for f := range report.Findings {
+		testSuite.TestCases = append(testSuite.TestCases, createTestCase(report.Cutoff, container, report.Findings[f]))
+	}
+	testSuite.Tests, testSuite.Failures, testSuite.Errors, testSuite.Skipped = countTestCases(testSuite.TestCases)
+	return testSuite
+}
 
-	allowListed, hit := helpers.InAllowList(*allowList, packageString)
+// newTestSuites combines a JUnitTestSuite per image into JUnitTestSuites, summing their counts.
+func newTestSuites(suites []JUnitTestSuite) (testSuites JUnitTestSuites) {
+	testSuites = JUnitTestSuites{
+		TestSuites: suites,
+		Name:       toolName,
+	}
+	for s := range suites {
+		testSuites.Tests += suites[s].Tests
+		testSuites.Failures += suites[s].Failures
+		testSuites.Errors += suites[s].Errors
+		testSuites.Skipped += suites[s].Skipped
+	}
+	return testSuites
+}
 
-	if err != nil {
-		panic(err)
+// newImageProperties returns JUnitProperties describing the tag, digest and registry of the image in an
+// ImageScanReport and the time its scan completed, omitting unknown values.
+// Returns nil when none are known so no empty properties element is written.
+func newImageProperties(report ImageScanReport) *JUnitProperties {
+	properties := &JUnitProperties{}
+	if tag := aws.StringValue(report.Image.ImageId.ImageTag); tag != "" {
+		properties.Properties = append(properties.Properties, JUnitProperty{Name: "tag", Value: tag})
+	}
+	if digest := aws.StringValue(report.Image.ImageId.ImageDigest); digest != "" {
+		properties.Properties = append(properties.Properties, JUnitProperty{Name: "digest", Value: digest})
+	}
+	if registry := aws.StringValue(report.Image.RegistryId); registry != "" {
+		properties.Properties = append(properties.Properties, JUnitProperty{Name: "registry", Value: registry})
+	}
+	if report.ScanCompletedAt != nil {
+		properties.Properties = append(properties.Properties, JUnitProperty{Name: "scan_completed_at", Value: report.ScanCompletedAt.UTC().Format(time.RFC3339)})
+	}
+	if len(properties.Properties) == 0 {
+		return nil
+	}
+	return properties
+}
+
+// countTestCases is used by newTestSuite to tally the test cases of a suite. Returns the number of tests, failures,
+// errors and skipped tests.
+func countTestCases(testCases []JUnitTestCase) (tests int, failures int, errors int, skipped int) {
+	for t := range testCases {
+		switch {
+		case testCases[t].FailureMessage != nil:
+			failures++
+		case testCases[t].ErrorMessage != nil:
+			errors++
+		case testCases[t].Skipped != nil:
+			skipped++
+		}
 	}
+	return len(testCases), failures, errors, skipped
+}
+
+// createTestCase converts a Finding to an annotated JUnitTestCase. Allowlisted findings are skipped, findings with an
+// undefined severity are errors and other findings pass or fail depending on the cutoff.
+// takes a cutoff (either 'LOW', 'MEDIUM', 'HIGH' or 'CRITICAL'), container (name) and an evaluated Finding
+func createTestCase(cutoff string, container string, finding Finding) (testCase JUnitTestCase) {
 	testCase = JUnitTestCase{
 		Name:      container,
-		ClassName: packageString,
+		ClassName: finding.Package,
 		Skipped:   nil,
 		Time:      0,
 		SystemOut: "",
 	}
-	if allowListed {
-		testCase.PassedMessage = newGenericPassedMessage("Vulnerability %s with severity %s matches queried allowListed pattern %s. PASSED!",
-			*finding.Name, *finding.Severity, hit)
+	if finding.AllowListed {
+		testCase.Skipped = &JUnitSkipped{
+			Message: fmt.Sprintf("Vulnerability %s with severity %s matches %s allowlist %s rule %s.%s%s",
+				finding.Name, finding.Severity, finding.AllowListEntry.Scope, finding.AllowListEntry.Kind(),
+				finding.AllowListHit, allowlistJustification(finding.AllowListEntry),
+				allowlistExpiry(finding.AllowListEntry)),
+		}
 		return testCase
-	} else if passed {
-		testCase.PassedMessage = newGenericPassedMessage("Vulnerability %s with severity %s below cutoff %s. PASSED!",
-			*finding.Name, *finding.Severity, cutoff)
+	} else if finding.NeedsReview {
+		testCase.ErrorMessage = &JUnitErrorMessage{
+			Type: finding.Severity,
+			Message: fmt.Sprintf("Vulnerability %s has severity %s and requires manual review.%s Description: %s",
+				finding.Name, finding.Severity, allowlistNotice(finding), descriptionOrDefault(finding.Description)),
+		}
+	} else if finding.PassedCutoff {
+		testCase.PassedMessage = newGenericPassedMessage("Vulnerability %s with severity %s below cutoff %s.%s PASSED!",
+			finding.Name, finding.Severity, cutoff, allowlistNotice(finding))
 	} else {
-		testCase.FailureMessage = newGenericFailedMessage(*finding.Severity,
-			"Vulnerability %s of severity %s above cutoff %s. FAILED! Description: %s",
-			*finding.Name, *finding.Severity, cutoff, helpers.StringPointerChecker(finding.Description, "No description provided"))
+		testCase.FailureMessage = newGenericFailedMessage(finding.Severity,
+			"Vulnerability %s of severity %s above cutoff %s.%s FAILED! Description: %s",
+			finding.Name, finding.Severity, cutoff, allowlistNotice(finding), descriptionOrDefault(finding.Description))
 	}
 	return testCase
 }
 
-//  newGenericPassedMessage takes a template string and an interface to return a formatted pointer to a JUnitPassedMessage
+// allowlistJustification describes the reason and owner of an allowlist entry (as far as they are known) for use in
+// test case messages. Returns an empty string when neither is known.
+func allowlistJustification(entry *helpers.AllowlistEntry) (justification string) {
+	if entry == nil {
+		return ""
+	}
+	if entry.Reason != "" {
+		justification += fmt.Sprintf(" Reason: %s.", entry.Reason)
+	}
+	if entry.Owner != "" {
+		justification += fmt.Sprintf(" Owner: %s.", entry.Owner)
+	}
+	return justification
+}
+
+// allowlistExpiry states until when an allowlist entry suppresses findings, or returns an empty string when the entry
+// does not expire.
+func allowlistExpiry(entry *helpers.AllowlistEntry) string {
+	if entry == nil || entry.Expires == "" {
+		return ""
+	}
+	return fmt.Sprintf(" Expires: %s.", entry.Expires)
+}
+
+// allowlistNotice returns a message stating which allowlist entry does not suppress a finding because it expired or is
+// capped below the severity of the finding, or an empty string when the finding did not match such an entry.
+func allowlistNotice(finding Finding) string {
+	if finding.AllowListExpired {
+		return fmt.Sprintf(" Allowlist entry %s expired on %s.%s", finding.AllowListEntry, finding.AllowListEntry.Expires,
+			allowlistJustification(finding.AllowListEntry))
+	}
+	if finding.AllowListCapped {
+		return fmt.Sprintf(" Allowlist entry %s only allows severities up to %s.%s", finding.AllowListEntry,
+			finding.AllowListEntry.MaxSeverity, allowlistJustification(finding.AllowListEntry))
+	}
+	return ""
+}
+
+// descriptionOrDefault returns the description of a finding or a default message when none was provided.
+func descriptionOrDefault(description string) string {
+	if description == "" {
+		return "No description provided"
+	}
+	return description
+}
+
+// newGenericPassedMessage takes a template string and an interface to return a formatted pointer to a JUnitPassedMessage
 func newGenericPassedMessage(template string, m ...interface{}) *JUnitPassedMessage {
 	return &JUnitPassedMessage{
 		Message: fmt.Sprintf(template, m...),
@@ -184,44 +325,12 @@ func newGenericFailedMessage(severity string, template string, m ...interface{})
 
 func xmlReportWriter(config helpers.ReporterConfig, suite JUnitTestSuite, l *logger.Logger) (err error) {
 
-	var filepath = path.Join(config.ReportBaseDir, config.ReportFileName)
-
-	// Attempt to handle non-existant ReportBaseDir by creating one if specified.
-	if config.ReportBaseDir != "" {
-		if _, err := os.Stat(config.ReportBaseDir); os.IsNotExist(err) {
-			err := os.Mkdir(config.ReportBaseDir, 0744)
-			helpers.Check(err, l, "Failed to create directory %s\n", config.ReportBaseDir)
-		}
-		helpers.Check(err, l, "")
+	// Massage JUnitTestSuite into nicely formatted xml
+	formattedSuite, err := xml.MarshalIndent(suite, "", "\t")
+	if err != nil {
+		l.Errorf("Failed to marshall and indent xml, %v", err)
+		return err
 	}
 
-	// Massage JUnitTestSuite into nicely formatted xml
-	formattedSuite, e := xml.MarshalIndent(suite, "", "\t")
-	helpers.Check(e, l, "Failed to marshall and indent xml, %v\n", err)
-
-	// Create and open file to write to (using defer to gracefully cleanup/close)
-	file, err := os.Create(filepath)
-	defer closeFile(file, l)
-	helpers.Check(err, l, "")
-	writer := bufio.NewWriter(file)
-
-	// Write out XML header tp file
-	l.Infof("writing header tp %s", filepath)
-	_, err = writer.WriteString(xml.Header)
-	helpers.Check(err, l, "Failed to write header to %s: %v", filepath, err)
-
-	// Write out rest of suite to file
-	l.Infof("writing results to %s", filepath)
-	_, err = writer.Write(formattedSuite)
-	helpers.Check(err, l, "Failed to write results to %s: %v", filepath, err)
-
-	// Clear writer.
-	err = writer.Flush()
-	return err
-}
-
-// closeFile closes an open file (pointer to os.File) and logs (pointer to logger.Logger) upon failure.
-func closeFile(file *os.File, l *logger.Logger) {
-	err := file.Close()
-	helpers.CheckAndExit(err, l, "Failed to close file : %v", file, err)
+	return reportFileWriter(config, xml.Header, formattedSuite, l)
 }
@@ -0,0 +1,179 @@
+package reporters
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/google/logger"
+	"github.com/kiwivogel/ecr-scan-util/helpers"
+)
+
+// Contains the Reporter interface every output format implements and the normalized findings we feed to them.
+
+// Reporter is implemented by every output format. A single run can use multiple reporters, each of them receives the
+// same ImageScanReport for every image.
+type Reporter interface {
+	// Name returns the name used to select this Reporter with --reporter.
+	Name() string
+	// FileExtension returns the extension used for files written by this Reporter (or an empty string if it does not
+	// write files). Used to create a helpers.ReporterConfig per Reporter.
+	FileExtension() string
+	// CreateReport writes out (or sends) a report for a single image. Returns an error upon failure.
+	CreateReport(report ImageScanReport, config helpers.ReporterConfig, l *logger.Logger) error
+}
+
+// RunReporter is implemented by reporters that (also) write out a report covering every image in a run. FinishRun is
+// called once after CreateReport was called for every image.
+type RunReporter interface {
+	// FinishRun writes out the report covering every image. Returns an error upon failure.
+	FinishRun(config helpers.ReporterConfig, l *logger.Logger) error
+}
+
+// availableReporters maps the names that can be passed to --reporter to a function creating that Reporter.
+var availableReporters = map[string]func() Reporter{
+	"junit":         newJUnitReporter,
+	"elasticsearch": newElasticsearchReporter,
+	"sarif":         newSarifReporter,
+	"json":          newJSONReporter,
+	"jsonl":         newJSONLinesReporter,
+}
+
+// ImageScanReport contains the normalized results of a scan for a single image. Cutoff and allowlist logic is applied
+// once when creating it so every Reporter reports the same outcome.
+type ImageScanReport struct {
+	Image           *ecr.Image        // Image that was scanned (including tag and digest if known)
+	Cutoff          string            // Cutoff used to evaluate the findings (either 'LOW', 'MEDIUM', 'HIGH' or 'CRITICAL')
+	ScanStatus      string            // ScanStatus as reported by ECR
+	ScanCompletedAt *time.Time        // ScanCompletedAt is the time the scan completed, nil if unknown
+	SourceUpdatedAt *time.Time        // SourceUpdatedAt is the time the vulnerability database used by the scan was last updated, nil if unknown
+	SeverityCounts  map[string]*int64 // SeverityCounts is the FindingSeverityCounts map from ecr.ImageScanFindings
+	Findings        []Finding         // Findings contains every individual (evaluated) finding
+}
+
+// Finding is a normalized ecr.ImageScanFinding with the outcome of the cutoff and allowlist evaluation.
+type Finding struct {
+	Name             string                  // Name of the vulnerability (usually the CVE identifier)
+	Severity         string                  // Severity as reported by ECR
+	URI              string                  // URI with more information on the vulnerability
+	Description      string                  // Description of the vulnerability, empty if none was provided
+	PackageName      string                  // PackageName is the package_name attribute of the finding
+	PackageVersion   string                  // PackageVersion is the package_version attribute of the finding
+	Package          string                  // Package formatted as package@version, which is what allowlist entries are matched against
+	Attributes       map[string]string       // Attributes contains all attributes of the finding
+	PassedCutoff     bool                    // PassedCutoff is true when the severity is below the cutoff
+	NeedsReview      bool                    // NeedsReview is true when the severity can not be compared to the cutoff (such as UNDEFINED), these never pass the cutoff
+	AllowListed      bool                    // AllowListed is true when the finding matched an allowlist entry
+	AllowListHit     string                  // AllowListHit is the allowlist entry the finding matched, empty if not allowlisted
+	AllowListEntry   *helpers.AllowlistEntry // AllowListEntry is the allowlist entry the finding matched (even if it expired), nil if none matched
+	AllowListExpired bool                    // AllowListExpired is true when the finding only matched an expired allowlist entry
+	AllowListCapped  bool                    // AllowListCapped is true when the finding only matched allowlist entries capped below its severity
+}
+
+// NewReporters takes a comma separated list of reporter names and returns the matching Reporters. Returns an error when
+// an unknown reporter is requested.
+func NewReporters(names string) (reporters []Reporter, err error) {
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		newReporter, present := availableReporters[name]
+		if !present {
+			return nil, fmt.Errorf("unknown reporter %s, available reporters: %s", name, strings.Join(reporterNames(), ", "))
+		}
+		reporters = append(reporters, newReporter())
+	}
+	if len(reporters) == 0 {
+		return nil, fmt.Errorf("no reporters specified, available reporters: %s", strings.Join(reporterNames(), ", "))
+	}
+	return reporters, nil
+}
+
+// NewImageScanReport takes an ecr.Image, the results of its scan, a cutoff (either 'LOW', 'MEDIUM', 'HIGH' or
+// 'CRITICAL') and a (flattened) allowList and returns an ImageScanReport with every finding evaluated.
+func NewImageScanReport(image *ecr.Image, result *ecr.DescribeImageScanFindingsOutput, cutoff string, allowList *[]helpers.AllowlistEntry) (report ImageScanReport) {
+	report = ImageScanReport{
+		Image:      image,
+		Cutoff:     cutoff,
+		ScanStatus: aws.StringValue(result.ImageScanStatus.Status),
+	}
+	// Record the registry the results came from when the default registry was used.
+	if image.RegistryId == nil && result.RegistryId != nil {
+		imageWithRegistry := *image
+		imageWithRegistry.RegistryId = result.RegistryId
+		report.Image = &imageWithRegistry
+	}
+	if result.ImageScanFindings == nil {
+		return report
+	}
+	report.ScanCompletedAt = result.ImageScanFindings.ImageScanCompletedAt
+	report.SourceUpdatedAt = result.ImageScanFindings.VulnerabilitySourceUpdatedAt
+	report.SeverityCounts = result.ImageScanFindings.FindingSeverityCounts
+	now := time.Now()
+	for f := range result.ImageScanFindings.Findings {
+		report.Findings = append(report.Findings, newFinding(result.ImageScanFindings.Findings[f], cutoff, allowList, now))
+	}
+	return report
+}
+
+// CountFailedFindings returns the number of findings in an ImageScanReport that are above the cutoff (or need review)
+// and not allowlisted.
+func CountFailedFindings(report ImageScanReport) (failures int) {
+	for f := range report.Findings {
+		if !report.Findings[f].PassedCutoff && !report.Findings[f].AllowListed {
+			failures++
+		}
+	}
+	return failures
+}
+
+// newFinding converts a ecr.ImageScanFinding to a Finding and evaluates it against the cutoff and allowList. Allowlist
+// entries that expired at the supplied time are recorded but do not suppress the finding.
+func newFinding(finding *ecr.ImageScanFinding, cutoff string, allowList *[]helpers.AllowlistEntry, now time.Time) (f Finding) {
+	f = Finding{
+		Name:        aws.StringValue(finding.Name),
+		Severity:    aws.StringValue(finding.Severity),
+		URI:         aws.StringValue(finding.Uri),
+		Description: aws.StringValue(finding.Description),
+		Attributes:  make(map[string]string),
+	}
+	for a := range finding.Attributes {
+		f.Attributes[aws.StringValue(finding.Attributes[a].Key)] = aws.StringValue(finding.Attributes[a].Value)
+	}
+	f.PackageName = f.Attributes["package_name"]
+	f.PackageVersion = f.Attributes["package_version"]
+	f.Package = fmt.Sprintf("%s@%s", f.PackageName, f.PackageVersion)
+
+	// Unknown severities are classified once here so the exit code and every reporter treat them the same.
+	_, knownSeverity := helpers.SeverityRanks[f.Severity]
+	f.NeedsReview = !knownSeverity
+	f.PassedCutoff = knownSeverity && hasPassedCutoff(cutoff, f.Severity)
+	allowListed, hit := helpers.InAllowList(*allowList, f.Name, f.Package, f.Severity, now)
+	if allowListed {
+		f.AllowListed, f.AllowListHit, f.AllowListEntry = true, hit.String(), &hit
+	} else if hit.Expired(now) {
+		f.AllowListExpired, f.AllowListEntry = true, &hit
+	} else if !hit.AllowsSeverity(f.Severity) {
+		f.AllowListCapped, f.AllowListEntry = true, &hit
+	}
+	return f
+}
+
+// hasPassedCutoff is a helper function used by newFinding to compare a findings severity to the cutoff to pass or fail a test
+// returns false if counted as failed and true if passed.
+func hasPassedCutoff(cutoff string, severity string) bool {
+	return !(helpers.SeverityRanks[severity] >= helpers.SeverityRanks[cutoff])
+}
+
+// reporterNames returns a sorted list of the names of all available reporters.
+func reporterNames() (names []string) {
+	for name := range availableReporters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
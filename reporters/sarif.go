@@ -0,0 +1,276 @@
+package reporters
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/google/logger"
+	"github.com/kiwivogel/ecr-scan-util/helpers"
+)
+
+// Contains a reporter writing out SARIF 2.1.0 logs, see https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html
+// We only implement the (small) subset of the format we need to describe findings.
+
+const (
+	sarifVersion = "2.1.0"
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	toolName     = "ecr-scan-util"
+	toolURI      = "https://github.com/kiwivogel/ecr-scan-util"
+)
+
+// SarifLog is the top level object of a SARIF file. We write a single SarifRun per image.
+type SarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []SarifRun `json:"runs"`
+}
+
+// SarifRun contains the results of scanning a single image.
+type SarifRun struct {
+	Tool              SarifTool              `json:"tool"`
+	AutomationDetails SarifAutomationDetails `json:"automationDetails"`
+	Results           []SarifResult          `json:"results"`
+	Properties        map[string]string      `json:"properties,omitempty"` //Tag and digest of the scanned image
+}
+
+// SarifTool describes this tool and the rules (one per vulnerability) results refer to.
+type SarifTool struct {
+	Driver SarifDriver `json:"driver"`
+}
+
+// SarifDriver describes this tool and the rules (one per vulnerability) results refer to.
+type SarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []SarifRule `json:"rules"`
+}
+
+// SarifAutomationDetails is used to tell runs for different images apart when uploading them.
+type SarifAutomationDetails struct {
+	ID string `json:"id"`
+}
+
+// SarifRule describes a single vulnerability.
+type SarifRule struct {
+	ID                   string                 `json:"id"`
+	Name                 string                 `json:"name"`
+	HelpURI              string                 `json:"helpUri,omitempty"`
+	ShortDescription     SarifMessage           `json:"shortDescription"`
+	FullDescription      SarifMessage           `json:"fullDescription"`
+	DefaultConfiguration SarifRuleConfiguration `json:"defaultConfiguration"`
+	Properties           SarifRuleProperties    `json:"properties"`
+}
+
+// SarifRuleConfiguration contains the level a rule is reported at.
+type SarifRuleConfiguration struct {
+	Level string `json:"level"`
+}
+
+// SarifRuleProperties contains the severity of a rule as reported by ECR and a numerical representation of it that is
+// used by code scanning dashboards.
+type SarifRuleProperties struct {
+	Severity         string   `json:"severity"`
+	SecuritySeverity string   `json:"security-severity,omitempty"`
+	Tags             []string `json:"tags"`
+}
+
+// SarifResult is a single finding located at the affected package.
+type SarifResult struct {
+	RuleID       string             `json:"ruleId"`
+	RuleIndex    int                `json:"ruleIndex"`
+	Level        string             `json:"level"`
+	Message      SarifMessage       `json:"message"`
+	Locations    []SarifLocation    `json:"locations"`
+	Suppressions []SarifSuppression `json:"suppressions,omitempty"`
+}
+
+// SarifMessage is a plain text message.
+type SarifMessage struct {
+	Text string `json:"text"`
+}
+
+// SarifLocation locates a result at the affected package@version.
+type SarifLocation struct {
+	PhysicalLocation SarifPhysicalLocation  `json:"physicalLocation"`
+	LogicalLocations []SarifLogicalLocation `json:"logicalLocations"`
+}
+
+// SarifPhysicalLocation points at the affected package@version as an artifact.
+type SarifPhysicalLocation struct {
+	ArtifactLocation SarifArtifactLocation `json:"artifactLocation"`
+}
+
+// SarifArtifactLocation contains the uri of an artifact.
+type SarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+// SarifLogicalLocation names the affected package.
+type SarifLogicalLocation struct {
+	Name               string `json:"name"`
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+	Kind               string `json:"kind"`
+}
+
+// SarifSuppression marks a result as suppressed (either by the allowlist or because it is below the cutoff) with a
+// justification.
+type SarifSuppression struct {
+	Kind          string `json:"kind"`
+	Justification string `json:"justification"`
+}
+
+// sarifReporter is the Reporter writing out SARIF logs.
+type sarifReporter struct{}
+
+// newSarifReporter returns a Reporter writing out SARIF logs.
+func newSarifReporter() Reporter {
+	return sarifReporter{}
+}
+
+// Name returns the name used to select the sarif reporter.
+func (sarifReporter) Name() string {
+	return "sarif"
+}
+
+// FileExtension returns the extension used for SARIF logs.
+func (sarifReporter) FileExtension() string {
+	return "sarif"
+}
+
+// CreateReport writes out a SARIF log containing a single run for an ImageScanReport.
+func (sarifReporter) CreateReport(report ImageScanReport, config helpers.ReporterConfig, l *logger.Logger) error {
+	l.Infof("Creating sarif report")
+	sarifLog := SarifLog{
+		Version: sarifVersion,
+		Schema:  sarifSchema,
+		Runs:    []SarifRun{newSarifRun(report)},
+	}
+	contents, err := json.MarshalIndent(sarifLog, "", "  ")
+	if err != nil {
+		return err
+	}
+	return reportFileWriter(config, "", contents, l)
+}
+
+// newSarifRun converts an ImageScanReport to a SarifRun with a rule per vulnerability and a result per finding. Findings
+// that are allowlisted or below the cutoff are marked as suppressed rather than omitted.
+func newSarifRun(report ImageScanReport) (run SarifRun) {
+	run = SarifRun{
+		Tool: SarifTool{
+			Driver: SarifDriver{
+				Name:           toolName,
+				InformationURI: toolURI,
+				Rules:          []SarifRule{},
+			},
+		},
+		AutomationDetails: SarifAutomationDetails{
+			ID: fmt.Sprintf("%s/%s/", toolName, aws.StringValue(report.Image.RepositoryName)),
+		},
+		Results:    []SarifResult{},
+		Properties: map[string]string{},
+	}
+	if tag := aws.StringValue(report.Image.ImageId.ImageTag); tag != "" {
+		run.Properties["tag"] = tag
+	}
+	if digest := aws.StringValue(report.Image.ImageId.ImageDigest); digest != "" {
+		run.Properties["digest"] = digest
+	}
+
+	// Keep track of the index of every rule so results can refer to it.
+	ruleIndices := make(map[string]int)
+	for f := range report.Findings {
+		finding := report.Findings[f]
+		index, present := ruleIndices[finding.Name]
+		if !present {
+			index = len(run.Tool.Driver.Rules)
+			ruleIndices[finding.Name] = index
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, newSarifRule(finding))
+		}
+		run.Results = append(run.Results, newSarifResult(report.Cutoff, index, finding))
+	}
+	return run
+}
+
+// newSarifRule creates a SarifRule describing the vulnerability of a Finding.
+func newSarifRule(finding Finding) SarifRule {
+	return SarifRule{
+		ID:               finding.Name,
+		Name:             finding.Name,
+		HelpURI:          finding.URI,
+		ShortDescription: SarifMessage{Text: finding.Name},
+		FullDescription:  SarifMessage{Text: descriptionOrDefault(finding.Description)},
+		DefaultConfiguration: SarifRuleConfiguration{
+			Level: sarifLevel(finding.Severity),
+		},
+		Properties: SarifRuleProperties{
+			Severity:         finding.Severity,
+			SecuritySeverity: sarifSecuritySeverity(finding.Severity),
+			Tags:             []string{"security", "vulnerability"},
+		},
+	}
+}
+
+// newSarifResult creates a SarifResult for a Finding referring to the rule at ruleIndex. Uses the same cutoff and
+// allowlist outcome as createTestCase, suppressing results that would pass.
+func newSarifResult(cutoff string, ruleIndex int, finding Finding) (result SarifResult) {
+	result = SarifResult{
+		RuleID:    finding.Name,
+		RuleIndex: ruleIndex,
+		Level:     sarifLevel(finding.Severity),
+		Message: SarifMessage{
+			Text: fmt.Sprintf("Vulnerability %s with severity %s in package %s", finding.Name, finding.Severity, finding.Package),
+		},
+		Locations: []SarifLocation{{
+			PhysicalLocation: SarifPhysicalLocation{
+				ArtifactLocation: SarifArtifactLocation{URI: finding.Package},
+			},
+			LogicalLocations: []SarifLogicalLocation{{
+				Name:               finding.PackageName,
+				FullyQualifiedName: finding.Package,
+				Kind:               "module",
+			}},
+		}},
+	}
+	if finding.AllowListed {
+		result.Suppressions = []SarifSuppression{{
+			Kind:          "external",
+			Justification: fmt.Sprintf("Matches allowlisted pattern %s", finding.AllowListHit),
+		}}
+	} else if finding.PassedCutoff {
+		result.Suppressions = []SarifSuppression{{
+			Kind:          "external",
+			Justification: fmt.Sprintf("Severity %s below cutoff %s", finding.Severity, cutoff),
+		}}
+	}
+	return result
+}
+
+// sarifLevel maps an ECR severity to a SARIF level.
+func sarifLevel(severity string) string {
+	switch severity {
+	case "CRITICAL", "HIGH":
+		return "error"
+	case "MEDIUM":
+		return "warning"
+	default:
+		return "note"
+	}
+}
+
+// sarifSecuritySeverity maps an ECR severity to the numerical security-severity used by code scanning dashboards.
+// Returns an empty string for severities that have no sensible numerical representation.
+func sarifSecuritySeverity(severity string) string {
+	switch severity {
+	case "CRITICAL":
+		return "9.5"
+	case "HIGH":
+		return "8.0"
+	case "MEDIUM":
+		return "5.5"
+	case "LOW":
+		return "2.0"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,70 @@
+package reporters
+
+import (
+	"bufio"
+	"os"
+	"path"
+
+	"github.com/google/logger"
+	"github.com/kiwivogel/ecr-scan-util/helpers"
+)
+
+// Contains logic shared by reporters that write out files.
+
+// reportFileWriter takes a helpers.ReporterConfig, a header, the contents of a report and a pointer to a logger.Logger
+// and writes the header followed by the contents to disk (based on parameters suppplied in the ReporterConfig).
+// Returns an error if this fails.
+func reportFileWriter(config helpers.ReporterConfig, header string, contents []byte, l *logger.Logger) (err error) {
+
+	var filepath = path.Join(config.ReportBaseDir, config.ReportFileName)
+
+	// Attempt to handle non-existant ReportBaseDir by creating one if specified.
+	if config.ReportBaseDir != "" {
+		if _, err := os.Stat(config.ReportBaseDir); os.IsNotExist(err) {
+			if err := os.Mkdir(config.ReportBaseDir, 0744); err != nil {
+				l.Errorf("Failed to create directory %s: %v", config.ReportBaseDir, err)
+				return err
+			}
+		}
+	}
+
+	// Create and open file to write to (using defer to gracefully cleanup/close)
+	file, err := os.Create(filepath)
+	if err != nil {
+		l.Errorf("Failed to create %s: %v", filepath, err)
+		return err
+	}
+	defer closeFile(file, &err, l)
+	writer := bufio.NewWriter(file)
+
+	// Write out header to file
+	if header != "" {
+		l.Infof("writing header to %s", filepath)
+		if _, err = writer.WriteString(header); err != nil {
+			l.Errorf("Failed to write header to %s: %v", filepath, err)
+			return err
+		}
+	}
+
+	// Write out rest of report to file
+	l.Infof("writing results to %s", filepath)
+	if _, err = writer.Write(contents); err != nil {
+		l.Errorf("Failed to write results to %s: %v", filepath, err)
+		return err
+	}
+
+	// Clear writer.
+	err = writer.Flush()
+	return err
+}
+
+// closeFile closes an open file (pointer to os.File) and logs (pointer to logger.Logger) upon failure. The error of
+// closing is stored in err unless it already holds an error.
+func closeFile(file *os.File, err *error, l *logger.Logger) {
+	if closeErr := file.Close(); closeErr != nil {
+		l.Errorf("Failed to close file %s: %v", file.Name(), closeErr)
+		if *err == nil {
+			*err = closeErr
+		}
+	}
+}